@@ -0,0 +1,159 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"expvar"
+	"html/template"
+	"log"
+	"net/http"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// Maximum number of keys of each kind to list on the admin page.
+const adminMaxKeys = 500
+
+// cacheVars exports the cache counters of every loaded site (keyed by site
+// key) via expvar, e.g. at /debug/vars if expvar.Handler is being served.
+var cacheVars = expvar.NewMap("saebr_cache")
+
+var cacheAdminTmpl = template.Must(template.New("cache.html").Parse(`<!DOCTYPE html>
+<html>
+
+<head>
+	<title>Cache</title>
+	<link rel="shortcut icon" href="/favicon.ico">
+	<link rel="stylesheet" href="https://fonts.googleapis.com/icon?family=Material+Icons">
+	<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/css/materialize.min.css" media="screen,projection" />
+	<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+</head>
+
+<body>
+	<header class="section light-blue darken-1">
+		<div class="container">
+			<h3 class="white-text">Cache</h3>
+		</div>
+	</header>
+	<article class="section">
+		<div class="container">
+			{{with .Purged}}<p class="green-text">Purged {{.}} entries.</p>{{end}}
+			{{with .Stats}}
+			<table>
+				<tr><th>Hits</th><td>{{.Hits}}</td></tr>
+				<tr><th>Stale hits</th><td>{{.StaleHits}}</td></tr>
+				<tr><th>Misses</th><td>{{.Misses}}</td></tr>
+				<tr><th>Fetch errors</th><td>{{.FetchErrors}}</td></tr>
+				<tr><th>Evictions</th><td>{{.Evictions}}</td></tr>
+				<tr><th>Entries</th><td>{{.Entries}} ({{.Bytes}} bytes)</td></tr>
+				<tr><th>404 entries</th><td>{{.NotFoundEntries}}</td></tr>
+			</table>
+			{{end}}
+			<div class="row">
+				<form method="POST" class="col s12">
+					<input type="hidden" name="XSRFToken" value="{{.XSRFToken}}">
+					<div class="input-field col s8">
+						<input type="text" name="Key">
+						<label for="Key">Key or prefix</label>
+						<span class="helper-text">e.g. /some-post, or / with "Prefix" to purge everything</span>
+					</div>
+					<div class="col s4">
+						<label>
+							<input type="checkbox" class="filled-in" name="Prefix">
+							<span>Prefix</span>
+						</label>
+						<button class="btn waves-effect waves-light" type="submit" name="action">Purge
+							<i class="material-icons right">delete</i>
+						</button>
+					</div>
+				</form>
+			</div>
+			<table class="striped">
+				<thead><tr><th>Key</th><th>Fetched</th><th>Size</th></tr></thead>
+				<tbody>
+				{{range .Keys}}
+					<tr><td>{{.Key}}{{if .NotFound}} <small>(404)</small>{{end}}</td><td>{{.Fetched.Format "2006-01-02 15:04:05"}}</td><td>{{.Size}}</td></tr>
+				{{end}}
+				</tbody>
+			</table>
+		</div>
+	</article>
+	<script type="text/javascript" src="https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/js/materialize.min.js"></script>
+</body>
+
+</html>`))
+
+type cacheAdminPage struct {
+	XSRFToken string
+	Stats     CacheStats
+	Keys      []cacheKeyInfo
+	Purged    int
+}
+
+// CacheStats returns a snapshot of the cache counters of each loaded site,
+// keyed by site key.
+func (s *Server) CacheStats() map[string]CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]CacheStats)
+	for key, ent := range s.sites {
+		select {
+		case <-ent.ready:
+			if ent.svr != nil {
+				m[key] = ent.svr.cache.stats()
+			}
+		default:
+			// Still loading.
+		}
+	}
+	return m
+}
+
+func (s *server) serveCacheAdmin(w http.ResponseWriter, r *http.Request, purged int) {
+	cp := &cacheAdminPage{
+		XSRFToken: xsrftoken.Generate(s.site.Secret, userID(r.Context()), "admin/cache"),
+		Stats:     s.cache.stats(),
+		Keys:      s.cache.keys(adminMaxKeys),
+		Purged:    purged,
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := cacheAdminTmpl.Execute(w, cp); err != nil {
+		log.Printf("Couldn't execute cacheAdminTmpl: %v", err)
+	}
+}
+
+func (s *server) handleCacheAdminGet(w http.ResponseWriter, r *http.Request) {
+	s.serveCacheAdmin(w, r, 0)
+}
+
+func (s *server) handleCacheAdminPost(w http.ResponseWriter, r *http.Request) {
+	if !xsrftoken.Valid(r.PostFormValue("XSRFToken"), s.site.Secret, userID(r.Context()), "admin/cache") {
+		http.Error(w, "bad XSRFToken", http.StatusBadRequest)
+		return
+	}
+	key := r.PostFormValue("Key")
+	if key == "" {
+		http.Error(w, "Key required", http.StatusBadRequest)
+		return
+	}
+	var purged int
+	if r.PostFormValue("Prefix") == "on" {
+		purged = s.cache.removePrefix(key)
+	} else {
+		purged = s.cache.remove(key)
+	}
+	log.Printf("%s purged %d cache entries for %q", userID(r.Context()), purged, key)
+	s.serveCacheAdmin(w, r, purged)
+}
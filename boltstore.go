@@ -0,0 +1,235 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout: Sites are stored in the "Site" bucket, keyed by the string
+// form of the site key. Pages are stored in a nested bucket of the "Page"
+// bucket per site (again keyed by the site key string), keyed by page name.
+// Values are JSON.
+var (
+	boltSiteBucket = []byte("Site")
+	boltPageBucket = []byte("Page")
+)
+
+// boltStore implements Store in a single local bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens (or creates) a bbolt database file for use as a Store.
+func OpenBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt db: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltSiteBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltPageBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create buckets: %v", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) GetSite(ctx context.Context, key *datastore.Key) (*Site, error) {
+	site := new(Site)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltSiteBucket).Get([]byte(key.String()))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, site)
+	})
+	if err != nil {
+		return nil, err
+	}
+	site.Key = key
+	return site, nil
+}
+
+func (b *boltStore) PutSite(ctx context.Context, site *Site) error {
+	v, err := json.Marshal(site)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSiteBucket).Put([]byte(site.Key.String()), v)
+	})
+}
+
+// pageBucket returns the bucket for the pages of a site, which may be nil if
+// the site has no pages.
+func pageBucket(tx *bolt.Tx, site *datastore.Key) *bolt.Bucket {
+	return tx.Bucket(boltPageBucket).Bucket([]byte(site.String()))
+}
+
+func (b *boltStore) GetPage(ctx context.Context, key *datastore.Key) (*Page, error) {
+	page := new(Page)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		pb := pageBucket(tx, key.Parent)
+		if pb == nil {
+			return ErrNotFound
+		}
+		v := pb.Get([]byte(key.Name))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, page)
+	})
+	if err != nil {
+		return nil, err
+	}
+	page.Key = key
+	return page, nil
+}
+
+func (b *boltStore) GetPages(ctx context.Context, keys []*datastore.Key) ([]*Page, error) {
+	pages := make([]*Page, len(keys))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			pb := pageBucket(tx, k.Parent)
+			if pb == nil {
+				continue
+			}
+			v := pb.Get([]byte(k.Name))
+			if v == nil {
+				continue
+			}
+			p := &Page{}
+			if err := json.Unmarshal(v, p); err != nil {
+				return fmt.Errorf("unmarshal page %q: %v", k.Name, err)
+			}
+			p.Key = k
+			pages[i] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func putPage(tx *bolt.Tx, page *Page) error {
+	v, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+	pb, err := tx.Bucket(boltPageBucket).CreateBucketIfNotExists([]byte(page.Key.Parent.String()))
+	if err != nil {
+		return err
+	}
+	return pb.Put([]byte(page.Key.Name), v)
+}
+
+func (b *boltStore) PutPage(ctx context.Context, page *Page) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putPage(tx, page)
+	})
+}
+
+func (b *boltStore) DeletePage(ctx context.Context, key *datastore.Key) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		pb := pageBucket(tx, key.Parent)
+		if pb == nil {
+			return nil
+		}
+		return pb.Delete([]byte(key.Name))
+	})
+}
+
+// queryPages scans the pages of a site for those matching the query.
+func queryPages(tx *bolt.Tx, site *datastore.Key, q PageQuery) ([]*Page, error) {
+	pb := pageBucket(tx, site)
+	if pb == nil {
+		return nil, nil
+	}
+	var pages []*Page
+	err := pb.ForEach(func(k, v []byte) error {
+		p := new(Page)
+		if err := json.Unmarshal(v, p); err != nil {
+			return fmt.Errorf("unmarshal page %q: %v", k, err)
+		}
+		if !p.Published || (q.BlogOnly && !p.Blog) {
+			return nil
+		}
+		p.Key = datastore.NameKey("Page", string(k), site)
+		pages = append(pages, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortPages(pages, q.Order)
+	if q.Limit > 0 && len(pages) > q.Limit {
+		pages = pages[:q.Limit]
+	}
+	for i, p := range pages {
+		pages[i] = projectPage(p, q)
+	}
+	return pages, nil
+}
+
+func (b *boltStore) QueryPages(ctx context.Context, site *datastore.Key, q PageQuery) ([]*Page, error) {
+	var pages []*Page
+	err := b.db.View(func(tx *bolt.Tx) error {
+		ps, err := queryPages(tx, site, q)
+		pages = ps
+		return err
+	})
+	return pages, err
+}
+
+func (b *boltStore) Relink(ctx context.Context, site *datastore.Key) ([]*datastore.Key, error) {
+	var changed []*Page
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		pages, err := queryPages(tx, site, PageQuery{BlogOnly: true, Order: "Created"})
+		if err != nil {
+			return err
+		}
+		// Put all changed pages.
+		changed = relinkPages(pages)
+		for _, p := range changed {
+			if err := putPage(tx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageKeys(changed), nil
+}
+
+// Close closes the database file.
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestBoltStoreSeedSite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "saebr.db")
+	seed := testSite(t)
+
+	st, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore(%q) = %v", path, err)
+	}
+	o := newOptions([]Option{SeedSite(seed, testPages()...)})
+	site, err := loadSite(ctx, st, "test", o)
+	if err != nil {
+		t.Fatalf("loadSite() = %v", err)
+	}
+	if site.AdminEmail != seed.AdminEmail || site.PageTemplate != seed.PageTemplate {
+		t.Errorf("loadSite() = %+v, want values from the seed %+v", site, seed)
+	}
+	if _, err := st.GetPage(ctx, datastore.NameKey("Page", "first", site.Key)); err != nil {
+		t.Errorf("GetPage(first) = %v", err)
+	}
+	st.(*boltStore).Close()
+
+	// Reopening, the stored site is used rather than the seed.
+	st, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore(%q) = %v", path, err)
+	}
+	defer st.(*boltStore).Close()
+	seed.AdminEmail = "someone.else@example.com"
+	reloaded, err := loadSite(ctx, st, "test", newOptions([]Option{SeedSite(seed)}))
+	if err != nil {
+		t.Fatalf("loadSite() = %v", err)
+	}
+	if reloaded.AdminEmail != site.AdminEmail || reloaded.Secret != site.Secret {
+		t.Errorf("loadSite() after reopening = %+v, want %+v", reloaded, site)
+	}
+}
+
+func TestServerCloseClosesBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "saebr.db")
+	s, err := New(context.Background(), "test", BoltDBPath(path), SeedSite(testSite(t)))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	// The file is locked while open.
+	st, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore(%q) after Close = %v", path, err)
+	}
+	st.(*boltStore).Close()
+}
@@ -15,59 +15,321 @@
 package saebr
 
 import (
+	"container/list"
 	"context"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"cloud.google.com/go/datastore"
 	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
 )
 
 type content interface {
-	Render(http.ResponseWriter, *http.Request)
+	// Render writes the content. maxAge is how much longer the content may be
+	// cached by clients (see setCacheHeaders).
+	Render(w http.ResponseWriter, r *http.Request, maxAge time.Duration)
+
+	// Size returns the (approximate) number of bytes the content takes when
+	// rendered.
+	Size() int
+
+	// output returns the rendered content, or nil if rendering failed.
+	output() *rendered
 }
 
 type cacheEntry struct {
-	fetched time.Time
-	content content
+	fetched  time.Time
+	content  content
+	notFound bool // content is the 404 page
+}
+
+// lru is a least-recently-used cache of entries, bounded by both number of
+// entries and total size. It is not safe for concurrent use.
+type lru struct {
+	maxEntries int
+	maxBytes   int // 0 = no limit
+
+	bytes     int
+	evictions int64
+	ll        list.List // of *lruItem, most recently used at the front
+	items     map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	ent  cacheEntry
+	size int
+}
+
+func newLRU(maxEntries, maxBytes int) *lru {
+	return &lru{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string) (cacheEntry, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	l.ll.MoveToFront(e)
+	return e.Value.(*lruItem).ent, true
+}
+
+func (l *lru) put(key string, ent cacheEntry, size int) {
+	if e, ok := l.items[key]; ok {
+		it := e.Value.(*lruItem)
+		l.bytes += size - it.size
+		it.ent, it.size = ent, size
+		l.ll.MoveToFront(e)
+	} else {
+		l.items[key] = l.ll.PushFront(&lruItem{key: key, ent: ent, size: size})
+		l.bytes += size
+	}
+	// Evict from the back until within limits, but always keep the entry
+	// just added.
+	for l.ll.Len() > 1 && (l.ll.Len() > l.maxEntries || (l.maxBytes > 0 && l.bytes > l.maxBytes)) {
+		l.removeElement(l.ll.Back())
+		l.evictions++
+	}
+}
+
+func (l *lru) remove(key string) bool {
+	e, ok := l.items[key]
+	if ok {
+		l.removeElement(e)
+	}
+	return ok
+}
+
+// removePrefix removes all entries with keys starting with prefix, and
+// returns the number removed.
+func (l *lru) removePrefix(prefix string) int {
+	n := 0
+	for key, e := range l.items {
+		if strings.HasPrefix(key, prefix) {
+			l.removeElement(e)
+			n++
+		}
+	}
+	return n
+}
+
+func (l *lru) removeElement(e *list.Element) {
+	it := l.ll.Remove(e).(*lruItem)
+	delete(l.items, it.key)
+	l.bytes -= it.size
+}
+
+// cacheBackend stores cache entries for a site. Implementations must be safe
+// for concurrent use.
+type cacheBackend interface {
+	get(key string) (cacheEntry, bool)
+	put(key string, ent cacheEntry)
+
+	// remove and removePrefix remove entries, and return the number removed.
+	// The empty prefix removes everything.
+	remove(keys ...string) int
+	removePrefix(prefix string) int
+
+	// stats fills in the entry-related fields of st.
+	stats(st *CacheStats)
+
+	// keys describes up to limit entries of each kind, most recently used
+	// first.
+	keys(limit int) []cacheKeyInfo
+
+	// close releases any resources held by the backend.
+	close()
+}
+
+// memCache is the in-process cacheBackend. Entries for the 404 page are kept
+// separately from the others, so that requests for lots of junk URLs can't
+// evict real content.
+type memCache struct {
+	mu        sync.Mutex
+	pages     *lru
+	notFounds *lru
+}
+
+func newMemCache(o *options) *memCache {
+	return &memCache{
+		pages:     newLRU(o.cacheMaxSize, o.cacheMaxBytes),
+		notFounds: newLRU(o.cacheMaxNotFound, 0),
+	}
+}
+
+func (m *memCache) get(key string) (cacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ent, ok := m.pages.get(key); ok {
+		return ent, true
+	}
+	return m.notFounds.get(key)
+}
+
+func (m *memCache) put(key string, ent cacheEntry) {
+	// Computing the size may involve rendering, so do it outside the lock.
+	size := 0
+	if !ent.notFound {
+		size = ent.content.Size()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ent.notFound {
+		m.pages.remove(key)
+		m.notFounds.put(key, ent, size)
+		return
+	}
+	m.notFounds.remove(key)
+	m.pages.put(key, ent, size)
+}
+
+func (m *memCache) remove(keys ...string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, key := range keys {
+		if m.pages.remove(key) || m.notFounds.remove(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *memCache) removePrefix(prefix string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pages.removePrefix(prefix) + m.notFounds.removePrefix(prefix)
+}
+
+func (m *memCache) stats(st *CacheStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st.Evictions = m.pages.evictions + m.notFounds.evictions
+	st.Entries = m.pages.ll.Len()
+	st.NotFoundEntries = m.notFounds.ll.Len()
+	st.Bytes = m.pages.bytes
+}
+
+func (m *memCache) keys(limit int) []cacheKeyInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var infos []cacheKeyInfo
+	for _, l := range []*lru{m.pages, m.notFounds} {
+		n := 0
+		for e := l.ll.Front(); e != nil && n < limit; e = e.Next() {
+			it := e.Value.(*lruItem)
+			infos = append(infos, cacheKeyInfo{
+				Key:      it.key,
+				Fetched:  it.ent.fetched,
+				Size:     it.size,
+				NotFound: it.ent.notFound,
+			})
+			n++
+		}
+	}
+	return infos
 }
 
+func (m *memCache) close() {}
+
+// cache holds recently fetched content for a site, in a cacheBackend.
 type cache struct {
-	limit    int
-	cache    map[string]cacheEntry
-	mu       sync.RWMutex
+	cacheBackend
 	notFound content
+
+	group singleflight.Group // for coalescing fetches
+
+	// Counters, for CacheStats
+	hits, staleHits, misses, fetchErrors atomic.Int64
 }
 
-func (c *cache) get(page string) (cacheEntry, bool) {
-	c.mu.RLock()
-	ent, ok := c.cache[page]
-	c.mu.RUnlock()
-	return ent, ok
+// newCache returns a cache for the site with the given key. It uses Redis if
+// configured (see RedisCache), otherwise it is in-process only.
+func newCache(o *options, siteKey string, notFound content) *cache {
+	var b cacheBackend = newMemCache(o)
+	if o.redisClient != nil {
+		b = newRedisCache(o.redisClient, siteKey, b.(*memCache), notFound)
+	}
+	return &cache{
+		cacheBackend: b,
+		notFound:     notFound,
+	}
 }
 
-// Random eviction cache.
-func (c *cache) put(page string, ent cacheEntry) {
-	c.mu.Lock()
-	for k := range c.cache {
-		if len(c.cache) < c.limit {
-			break
+// CacheStats is a snapshot of the page cache counters for a site. When a
+// shared cache is in use, the entry counts are of the in-process part.
+type CacheStats struct {
+	Hits            int64 // requests served from a fresh entry
+	StaleHits       int64 // requests served from a stale entry while refreshing
+	Misses          int64 // requests that had to wait for a fetch
+	FetchErrors     int64 // fetches that failed other than with "not found"
+	Evictions       int64 // entries evicted to make room
+	Entries         int   // current number of entries, excluding 404s
+	NotFoundEntries int   // current number of 404 entries
+	Bytes           int   // current total size of entries
+}
+
+func (c *cache) stats() CacheStats {
+	st := CacheStats{
+		Hits:        c.hits.Load(),
+		StaleHits:   c.staleHits.Load(),
+		Misses:      c.misses.Load(),
+		FetchErrors: c.fetchErrors.Load(),
+	}
+	c.cacheBackend.stats(&st)
+	return st
+}
+
+// cacheKeyInfo describes one cache entry, for the admin page.
+type cacheKeyInfo struct {
+	Key      string
+	Fetched  time.Time
+	Size     int
+	NotFound bool
+}
+
+// aggregateKeys are the cache keys of content listing many pages, which
+// needs refreshing whenever any page changes.
+var aggregateKeys = []string{
+	"/", // when serving the latest post at the root
+	"/index",
+	"/rss.xml",
+	"/atom.xml",
+	"/feed.json",
+	"/sitemap.xml",
+}
+
+// invalidate removes the given pages, and all aggregate content, from the
+// cache (and, with a shared cache, from every other instance's cache too). Nil
+// keys are ignored.
+func (s *server) invalidate(pages ...*datastore.Key) {
+	keys := append([]string(nil), aggregateKeys...)
+	for _, k := range pages {
+		if k != nil {
+			keys = append(keys, "/"+k.Name)
 		}
-		delete(c.cache, k)
 	}
-	c.cache[page] = ent
-	c.mu.Unlock()
+	s.cache.remove(keys...)
 }
 
 type fetcherFunc func(context.Context, map[string]string) (content, error)
 
-func (c *cache) server(fetcher fetcherFunc, key string) *cacheServer {
+func (c *cache) server(fetcher fetcherFunc, key string, ttl time.Duration) *cacheServer {
 	return &cacheServer{
 		cache:   c,
 		fetcher: fetcher,
 		key:     key,
+		ttl:     ttl,
 	}
 }
 
@@ -75,6 +337,22 @@ type cacheServer struct {
 	cache   *cache
 	fetcher fetcherFunc
 	key     string
+	ttl     time.Duration // 0 = don't cache
+}
+
+// setCacheHeaders sets the Cache-Control and Expires headers for content
+// that may be cached for maxAge. If maxAge is zero, clients must revalidate.
+// If maxAge is negative, the content is private and must not be stored.
+func setCacheHeaders(h http.Header, maxAge time.Duration) {
+	switch {
+	case maxAge < 0:
+		h.Set("Cache-Control", "private, no-store")
+	case maxAge < time.Second:
+		h.Set("Cache-Control", "no-cache")
+	default:
+		h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+		h.Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+	}
 }
 
 var skipSuffixes = []string{
@@ -98,34 +376,97 @@ func (c *cacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, canc := context.WithTimeout(r.Context(), 10*time.Second)
-	defer canc()
-
 	vars := mux.Vars(r)
 	key := c.key
 	if key == "" {
 		key = r.URL.Path
 	}
 
+	if c.ttl <= 0 {
+		c.serveUncached(w, r, key, vars)
+		return
+	}
+
 	// In cache?
 	if ent, found := c.cache.get(key); found {
-		// Is it fresh enough to serve?
-		if ent.fetched.Add(cacheTTL).After(time.Now()) {
-			ent.content.Render(w, r)
-			return
+		// If it's stale, refresh it in the background, but serve the stale
+		// copy in the meantime.
+		remaining := time.Until(ent.fetched.Add(c.ttl))
+		if remaining <= 0 {
+			c.cache.staleHits.Add(1)
+			go c.refresh(key, vars)
+		} else {
+			c.cache.hits.Add(1)
 		}
+		ent.content.Render(w, r, max(remaining, 0))
+		return
 	}
 
-	cont, err := c.fetcher(ctx, vars)
+	c.cache.misses.Add(1)
+	ent, err := c.refresh(key, vars)
+	if err != nil {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	ent.content.Render(w, r, c.ttl)
+}
+
+// serveUncached fetches and serves content without using the cache.
+func (c *cacheServer) serveUncached(w http.ResponseWriter, r *http.Request, key string, vars map[string]string) {
+	ctx, canc := context.WithTimeout(r.Context(), 10*time.Second)
+	defer canc()
+
+	cont, err := c.fetcher(withPath(ctx, key), vars)
 	if err != nil {
 		log.Printf("Couldn't fetch content for %q: %v", key, err)
+		if !isNotFound(err) {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
 	}
 	if cont == nil {
 		cont = c.cache.notFound
 	}
-	c.cache.put(key, cacheEntry{
-		fetched: time.Now(),
-		content: cont,
+	cont.Render(w, r, 0)
+}
+
+// refresh fetches the content for key and puts it in the cache. Concurrent
+// refreshes of the same key share a single fetch. If the fetch fails for a
+// reason other than the content not existing, the existing entry (if any) is
+// kept for another TTL, otherwise refresh returns the error.
+func (c *cacheServer) refresh(key string, vars map[string]string) (cacheEntry, error) {
+	v, err, _ := c.cache.group.Do(key, func() (any, error) {
+		// The result is shared, so don't tie the fetch to any one request.
+		ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+		defer canc()
+
+		cont, err := c.fetcher(withPath(ctx, key), vars)
+		if err != nil {
+			log.Printf("Couldn't fetch content for %q: %v", key, err)
+			if !isNotFound(err) {
+				c.cache.fetchErrors.Add(1)
+				ent, found := c.cache.get(key)
+				if !found {
+					return nil, err
+				}
+				ent.fetched = time.Now()
+				c.cache.put(key, ent)
+				return ent, nil
+			}
+		}
+		ent := cacheEntry{
+			fetched:  time.Now(),
+			content:  cont,
+			notFound: cont == nil,
+		}
+		if ent.notFound {
+			ent.content = c.cache.notFound
+		}
+		c.cache.put(key, ent)
+		return ent, nil
 	})
-	cont.Render(w, r)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	return v.(cacheEntry), nil
 }
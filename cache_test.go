@@ -0,0 +1,175 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// lruKeys returns the keys in the LRU, most recently used first.
+func lruKeys(l *lru) []string {
+	var keys []string
+	for e := l.ll.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*lruItem).key)
+	}
+	return keys
+}
+
+func TestLRU(t *testing.T) {
+	l := newLRU(3, 100)
+	l.put("a", cacheEntry{}, 10)
+	l.put("b", cacheEntry{}, 10)
+	l.put("c", cacheEntry{}, 10)
+	if _, ok := l.get("a"); !ok {
+		t.Fatal("get(a) missing")
+	}
+	// a was used more recently than b, so b is evicted.
+	l.put("d", cacheEntry{}, 10)
+	if got, want := lruKeys(l), []string{"d", "a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("after evicting by entries, keys = %v, want %v", got, want)
+	}
+	if l.evictions != 1 {
+		t.Errorf("evictions = %d, want 1", l.evictions)
+	}
+
+	// Replacing an entry updates its size.
+	l.put("a", cacheEntry{notFound: true}, 50)
+	if l.bytes != 70 {
+		t.Errorf("bytes = %d, want 70", l.bytes)
+	}
+	if ent, _ := l.get("a"); !ent.notFound {
+		t.Error("get(a) returned the old entry")
+	}
+
+	// Evicting by size removes as many as needed.
+	l.put("e", cacheEntry{}, 45)
+	if got, want := lruKeys(l), []string{"e", "a"}; !slices.Equal(got, want) {
+		t.Errorf("after evicting by size, keys = %v, want %v", got, want)
+	}
+	if l.bytes != 95 {
+		t.Errorf("bytes = %d, want 95", l.bytes)
+	}
+
+	// An entry bigger than the limit is still kept, by itself.
+	l.put("huge", cacheEntry{}, 500)
+	if got, want := lruKeys(l), []string{"huge"}; !slices.Equal(got, want) {
+		t.Errorf("after adding a huge entry, keys = %v, want %v", got, want)
+	}
+
+	if !l.remove("huge") || l.remove("huge") {
+		t.Error("remove(huge) twice didn't return true then false")
+	}
+
+	l.put("/a/1", cacheEntry{}, 1)
+	l.put("/a/2", cacheEntry{}, 1)
+	l.put("/b", cacheEntry{}, 1)
+	if n := l.removePrefix("/a/"); n != 2 {
+		t.Errorf("removePrefix(/a/) = %d, want 2", n)
+	}
+	if !l.remove("/b") {
+		t.Error("remove(/b) = false, want true")
+	}
+	if l.ll.Len() != 0 || len(l.items) != 0 || l.bytes != 0 {
+		t.Errorf("after removing everything, len = %d, items = %d, bytes = %d; want all 0", l.ll.Len(), len(l.items), l.bytes)
+	}
+}
+
+// postEdit posts the edit form for a page as the admin, as the browser would.
+func postEdit(t *testing.T, s *Server, name string, form url.Values) *http.Response {
+	t.Helper()
+	ent, err := s.site(context.Background(), s.defKey)
+	if err != nil {
+		t.Fatalf("s.site() = %v", err)
+	}
+	site := ent.svr.site
+
+	// Log in.
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	sess, _ := site.cookieStore.Get(r, "userinfo")
+	sess.Values["user_id"] = site.AdminEmail
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatalf("sess.Save() = %v", err)
+	}
+
+	form.Set("XSRFToken", xsrftoken.Generate(site.Secret, site.AdminEmail, "edit/"+name))
+	path := "/edit"
+	if name != "" {
+		path += "/" + name
+	}
+	r = httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestEditInvalidatesCache(t *testing.T) {
+	s := newTestServer(t)
+
+	// Fill the cache.
+	for _, path := range []string{"/first", "/second", "/rss.xml"} {
+		if res, _ := get(t, s, path); res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200", path, res.StatusCode)
+		}
+	}
+
+	res := postEdit(t, s, "first", url.Values{
+		"Title":     {"First post, edited"},
+		"Contents":  {"Edited contents."},
+		"Published": {"on"},
+		"Blog":      {"on"},
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST /edit/first status = %d, want 200", res.StatusCode)
+	}
+
+	if _, body := get(t, s, "/first"); !strings.Contains(body, "Edited contents.") {
+		t.Errorf("GET /first after editing = %q, want the edited contents", body)
+	}
+	if _, body := get(t, s, "/rss.xml"); !strings.Contains(body, "First post, edited") {
+		t.Errorf("GET /rss.xml after editing = %q, want the edited title", body)
+	}
+
+	// Creating a new post changes the latest post, and the links from the
+	// previous latest post.
+	res = postEdit(t, s, "", url.Values{
+		"Key":       {"third"},
+		"Title":     {"Third post"},
+		"Contents":  {"Third contents."},
+		"Published": {"on"},
+		"Blog":      {"on"},
+	})
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("POST /edit status = %d, want 302", res.StatusCode)
+	}
+	if res, _ := get(t, s, "/latest"); !strings.HasSuffix(res.Header.Get("Location"), "/third") {
+		t.Errorf("GET /latest Location = %q, want the new post", res.Header.Get("Location"))
+	}
+	if _, body := get(t, s, "/rss.xml"); !strings.Contains(body, "Third post") {
+		t.Errorf("GET /rss.xml after creating a post = %q, want the new post", body)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// datastoreStore implements Store using Cloud Datastore.
+type datastoreStore struct {
+	client *datastore.Client
+}
+
+func newDatastoreStore(ctx context.Context, projID string) (*datastoreStore, error) {
+	client, err := datastore.NewClient(ctx, projID)
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreStore{client: client}, nil
+}
+
+func (d *datastoreStore) GetSite(ctx context.Context, key *datastore.Key) (*Site, error) {
+	site := &Site{Key: key}
+	if err := d.client.Get(ctx, key, site); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return site, nil
+}
+
+func (d *datastoreStore) PutSite(ctx context.Context, site *Site) error {
+	_, err := d.client.Put(ctx, site.Key, site)
+	return err
+}
+
+func (d *datastoreStore) GetPage(ctx context.Context, key *datastore.Key) (*Page, error) {
+	page := &Page{Key: key}
+	if err := d.client.Get(ctx, key, page); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return page, nil
+}
+
+func (d *datastoreStore) GetPages(ctx context.Context, keys []*datastore.Key) ([]*Page, error) {
+	pages := make([]*Page, len(keys))
+	for i, k := range keys {
+		pages[i] = &Page{Key: k}
+	}
+	err := d.client.GetMulti(ctx, keys, pages)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for i, err := range merr {
+			switch err {
+			case nil:
+			case datastore.ErrNoSuchEntity:
+				pages[i] = nil
+			default:
+				return nil, err
+			}
+		}
+		return pages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func (d *datastoreStore) PutPage(ctx context.Context, page *Page) error {
+	_, err := d.client.Put(ctx, page.Key, page)
+	return err
+}
+
+func (d *datastoreStore) DeletePage(ctx context.Context, key *datastore.Key) error {
+	return d.client.Delete(ctx, key)
+}
+
+func pageQuery(site *datastore.Key, q PageQuery) *datastore.Query {
+	dq := datastore.NewQuery("Page").
+		Ancestor(site).
+		FilterField("Published", "=", true)
+	if q.BlogOnly {
+		dq = dq.FilterField("Blog", "=", true)
+	}
+	if q.Order != "" {
+		dq = dq.Order(q.Order)
+	}
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	switch {
+	case q.KeysOnly:
+		dq = dq.KeysOnly()
+	case q.TimesOnly:
+		dq = dq.Project("Created", "LastModified")
+	}
+	return dq
+}
+
+func (d *datastoreStore) QueryPages(ctx context.Context, site *datastore.Key, q PageQuery) ([]*Page, error) {
+	if q.KeysOnly {
+		keys, err := d.client.GetAll(ctx, pageQuery(site, q), nil)
+		if err != nil {
+			return nil, err
+		}
+		pages := make([]*Page, 0, len(keys))
+		for _, k := range keys {
+			pages = append(pages, &Page{Key: k})
+		}
+		return pages, nil
+	}
+	var pages []*Page
+	if _, err := d.client.GetAll(ctx, pageQuery(site, q), &pages); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func (d *datastoreStore) Relink(ctx context.Context, site *datastore.Key) ([]*datastore.Key, error) {
+	var changed []*Page
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		q := pageQuery(site, PageQuery{BlogOnly: true, Order: "Created"}).Transaction(tx)
+
+		var pages []*Page
+		if _, err := d.client.GetAll(ctx, q, &pages); err != nil {
+			return err
+		}
+		// Put all changed pages.
+		changed = relinkPages(pages)
+		for _, p := range changed {
+			if _, err := tx.Put(p.Key, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageKeys(changed), nil
+}
@@ -0,0 +1,685 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"html/template"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/awalterschulze/gographviz"
+)
+
+// diagramRenderers render the contents of fenced code blocks in each
+// language to SVG.
+var diagramRenderers = map[string]func(src string) (string, error){
+	"dot":      renderDot,
+	"graphviz": renderDot,
+	"mermaid": func(string) (string, error) {
+		return "", errors.New("mermaid diagrams are not supported; try dot")
+	},
+}
+
+// extractDiagrams replaces fenced code blocks in diagram languages (see
+// diagramRenderers) in Markdown contents with placeholders, appending the
+// rendered diagram for each to subs. A diagram that can't be rendered is
+// replaced with an error (shown only in previews) and the code block. Code
+// blocks may be within list items or blockquotes, but not other code blocks.
+func extractDiagrams(src string, subs []template.HTML) (string, []template.HTML) {
+	var out strings.Builder
+	var blocks mdBlocks
+	for len(src) > 0 {
+		line := nextLine(src)
+		src = src[len(line):]
+		inFence := blocks.fence != ""
+		if blocks.verbatim(line) && (inFence || blocks.fence == "") {
+			// Within a code block or HTML block.
+			out.WriteString(line)
+			continue
+		}
+		prefix := containerPrefix(line)
+		fence, info := openingFence(line[len(prefix):])
+		lang, _, _ := strings.Cut(info, " ")
+		render := diagramRenderers[lang]
+		if fence == "" || render == nil {
+			out.WriteString(line)
+			continue
+		}
+
+		var code strings.Builder
+		for len(src) > 0 {
+			l := nextLine(src)
+			src = src[len(l):]
+			l = strings.TrimPrefix(l, prefix)
+			if closesFence(l, fence) {
+				break
+			}
+			code.WriteString(l)
+		}
+		blocks.fence = ""
+
+		var h string
+		svg, err := render(code.String())
+		if err != nil {
+			h = previewError("Invalid "+lang+" diagram", err) + `<pre><code class="language-` + html.EscapeString(lang) + `">` +
+				html.EscapeString(code.String()) + `</code></pre>`
+		} else {
+			h = `<div class="diagram">` + svg + `</div>`
+		}
+		// On its own, so it is a paragraph of its own, but within the same
+		// list item or blockquote as the code block was.
+		// (Some renderers end lists at two blank lines in a row.)
+		blank := strings.TrimRight(prefix, " \t") + "\n"
+		if !isBlankLine(lastLine(out.String()), blank) {
+			out.WriteString(blank)
+		}
+		out.WriteString(prefix + placeholder(len(subs)) + "\n")
+		if !isBlankLine(nextLine(src), blank) {
+			out.WriteString(blank)
+		}
+		subs = append(subs, template.HTML(h))
+	}
+	return out.String(), subs
+}
+
+// lastLine returns the last complete line of s, including the newline.
+func lastLine(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return s[strings.LastIndexByte(s, '\n')+1:] + "\n"
+}
+
+// isBlankLine reports whether the line is blank, or only the container
+// prefix of a blank line.
+func isBlankLine(line, blank string) bool {
+	return strings.TrimSpace(line) == "" || strings.TrimSpace(line) == strings.TrimSpace(blank)
+}
+
+// containerPrefix returns the indentation and blockquote markers at the
+// start of a line, which also prefix the following lines of a code block
+// starting on that line.
+func containerPrefix(line string) string {
+	i := 0
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == '>') {
+		i++
+	}
+	return line[:i]
+}
+
+// dotNode is a node of a graph being laid out. Long edges are split into
+// chains of dummy nodes, one per layer crossed.
+type dotNode struct {
+	name    string
+	attrs   gographviz.Attrs
+	lines   []string // of the label
+	shape   string
+	w, h    float64 // size
+	x, y    float64 // centre
+	layer   int
+	order   float64 // position within the layer, while ordering
+	dummy   bool
+	in, out []int // neighbours in the layers above and below
+}
+
+// dotEdge is an edge of a graph being laid out.
+type dotEdge struct {
+	attrs  gographviz.Attrs
+	path   []int // nodes the edge passes through, from source to destination
+	loop   bool
+	offset float64 // sideways, to separate edges between the same nodes
+}
+
+const (
+	dotFontSize   = 14
+	dotLineHeight = 18
+	dotNodeSep    = 24 // between nodes in a layer
+	dotRankSep    = 48 // between layers
+	dotMargin     = 8
+	dotEdgeSep    = 16 // between edges joining the same nodes
+)
+
+// renderDot lays out a graph written in the DOT language, and draws it as
+// SVG. The layout is a simple layered one, in the style of Graphviz's dot.
+// Clusters, ports, and most attributes are ignored.
+func renderDot(src string) (svg string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	g, err := gographviz.Read([]byte(src))
+	if err != nil {
+		return "", err
+	}
+
+	var nodes []*dotNode
+	index := make(map[string]int)
+	addNode := func(name string, attrs gographviz.Attrs) int {
+		if i, ok := index[name]; ok {
+			return i
+		}
+		n := &dotNode{name: name, attrs: attrs}
+		n.shape = dotAttr(attrs, "shape")
+		label := dotAttr(attrs, "label")
+		if _, ok := attrs["label"]; !ok {
+			label = name
+		}
+		label = strings.ReplaceAll(label, `\N`, name)
+		n.lines = dotLabelLines(label)
+		n.w, n.h = dotNodeSize(n)
+		index[name] = len(nodes)
+		nodes = append(nodes, n)
+		return index[name]
+	}
+	for _, n := range g.Nodes.Nodes {
+		addNode(dotID(n.Name), n.Attrs)
+	}
+
+	// Make the graph acyclic for layering by reversing edges that go back
+	// up the depth-first search.
+	var edges []*dotEdge
+	succ := make([][]int, len(nodes))
+	type pair struct{ from, to int }
+	var pairs []pair
+	for _, e := range g.Edges.Edges {
+		from := addNode(dotID(e.Src), gographviz.Attrs{})
+		to := addNode(dotID(e.Dst), gographviz.Attrs{})
+		for len(succ) < len(nodes) {
+			succ = append(succ, nil)
+		}
+		edges = append(edges, &dotEdge{attrs: e.Attrs, path: []int{from, to}, loop: from == to})
+		pairs = append(pairs, pair{from, to})
+		if from != to {
+			succ[from] = append(succ[from], to)
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(nodes))
+	back := make(map[pair]bool)
+	var dfs func(int)
+	dfs = func(u int) {
+		state[u] = visiting
+		for _, v := range succ[u] {
+			switch state[v] {
+			case unvisited:
+				dfs(v)
+			case visiting:
+				back[pair{u, v}] = true
+			}
+		}
+		state[u] = visited
+	}
+	for u := range nodes {
+		if state[u] == unvisited {
+			dfs(u)
+		}
+	}
+
+	// Assign layers by longest path from the sources.
+	indeg := make([]int, len(nodes))
+	down := make([][]int, len(nodes))
+	for i, p := range pairs {
+		if edges[i].loop {
+			continue
+		}
+		if back[p] {
+			p.from, p.to = p.to, p.from
+		}
+		down[p.from] = append(down[p.from], p.to)
+		indeg[p.to]++
+	}
+	var queue []int
+	for u := range nodes {
+		if indeg[u] == 0 {
+			queue = append(queue, u)
+		}
+	}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for _, v := range down[u] {
+			nodes[v].layer = max(nodes[v].layer, nodes[u].layer+1)
+			if indeg[v]--; indeg[v] == 0 {
+				queue = append(queue, v)
+			}
+		}
+	}
+
+	// Split long edges with dummy nodes, and link neighbouring layers.
+	for i, e := range edges {
+		if e.loop {
+			continue
+		}
+		from, to := e.path[0], e.path[1]
+		reversed := back[pairs[i]]
+		if reversed {
+			from, to = to, from
+		}
+		path := []int{from}
+		for l := nodes[from].layer + 1; l < nodes[to].layer; l++ {
+			nodes = append(nodes, &dotNode{dummy: true, layer: l, w: 2, h: 2})
+			path = append(path, len(nodes)-1)
+		}
+		path = append(path, to)
+		for j := 1; j < len(path); j++ {
+			nodes[path[j-1]].out = append(nodes[path[j-1]].out, path[j])
+			nodes[path[j]].in = append(nodes[path[j]].in, path[j-1])
+		}
+		if reversed {
+			for a, b := 0, len(path)-1; a < b; a, b = a+1, b-1 {
+				path[a], path[b] = path[b], path[a]
+			}
+		}
+		e.path = path
+	}
+
+	// Edges directly joining the same two nodes (such as a->b and b->a) are
+	// drawn curving to either side, so they don't overlap.
+	type span struct{ a, b int }
+	parallel := make(map[span][]*dotEdge)
+	var spans []span
+	for _, e := range edges {
+		if e.loop || len(e.path) != 2 {
+			continue
+		}
+		sp := span{min(e.path[0], e.path[1]), max(e.path[0], e.path[1])}
+		if parallel[sp] == nil {
+			spans = append(spans, sp)
+		}
+		parallel[sp] = append(parallel[sp], e)
+	}
+	for _, sp := range spans {
+		es := parallel[sp]
+		for k, e := range es {
+			e.offset = (float64(k) - float64(len(es)-1)/2) * dotEdgeSep
+		}
+	}
+
+	// Order the nodes within each layer to reduce crossings, by sweeping
+	// down and up a few times, sorting by the average position of
+	// neighbours in the previous layer.
+	var layers [][]int
+	for i, n := range nodes {
+		for len(layers) <= n.layer {
+			layers = append(layers, nil)
+		}
+		n.order = float64(len(layers[n.layer]))
+		layers[n.layer] = append(layers[n.layer], i)
+	}
+	sortLayer := func(layer []int, neighbours func(*dotNode) []int) {
+		key := make(map[int]float64, len(layer))
+		for _, u := range layer {
+			key[u] = nodes[u].order
+			if ns := neighbours(nodes[u]); len(ns) > 0 {
+				sum := 0.0
+				for _, v := range ns {
+					sum += nodes[v].order
+				}
+				key[u] = sum / float64(len(ns))
+			}
+		}
+		sort.SliceStable(layer, func(i, j int) bool { return key[layer[i]] < key[layer[j]] })
+		for i, u := range layer {
+			nodes[u].order = float64(i)
+		}
+	}
+	for range 4 {
+		for l := 1; l < len(layers); l++ {
+			sortLayer(layers[l], func(n *dotNode) []int { return n.in })
+		}
+		for l := len(layers) - 2; l >= 0; l-- {
+			sortLayer(layers[l], func(n *dotNode) []int { return n.out })
+		}
+	}
+
+	// Position the nodes: layers are stacked along the rank axis, and each
+	// layer is centred on the cross axis.
+	rankdir := strings.ToUpper(dotAttr(g.Attrs, "rankdir"))
+	horizontal := rankdir == "LR" || rankdir == "RL"
+	size := func(n *dotNode) (cross, rank float64) {
+		if horizontal {
+			return n.h, n.w
+		}
+		return n.w, n.h
+	}
+	var crossMax, rankPos float64
+	crossWidths := make([]float64, len(layers))
+	for l, layer := range layers {
+		for i, u := range layer {
+			c, _ := size(nodes[u])
+			if i > 0 {
+				crossWidths[l] += dotNodeSep
+			}
+			crossWidths[l] += c
+		}
+		crossMax = max(crossMax, crossWidths[l])
+	}
+	for l, layer := range layers {
+		depth := 0.0
+		for _, u := range layer {
+			_, r := size(nodes[u])
+			depth = max(depth, r)
+		}
+		pos := (crossMax - crossWidths[l]) / 2
+		for _, u := range layer {
+			n := nodes[u]
+			c, _ := size(n)
+			cross, rank := pos+c/2, rankPos+depth/2
+			if horizontal {
+				n.x, n.y = rank, cross
+			} else {
+				n.x, n.y = cross, rank
+			}
+			pos += c + dotNodeSep
+		}
+		rankPos += depth + dotRankSep
+	}
+	rankPos -= dotRankSep
+	width, height := crossMax, rankPos
+	if horizontal {
+		width, height = rankPos, crossMax
+	}
+	for _, n := range nodes {
+		if rankdir == "BT" {
+			n.y = height - n.y
+		}
+		if rankdir == "RL" {
+			n.x = width - n.x
+		}
+		n.x += dotMargin
+		n.y += dotMargin
+	}
+	width += 2 * dotMargin
+	height += 2 * dotMargin
+
+	// Draw it.
+	h := fnv.New32a()
+	h.Write([]byte(src))
+	arrowID := fmt.Sprintf("arrow-%08x", h.Sum32())
+	graphLabel := dotAttr(g.Attrs, "label")
+	if graphLabel != "" {
+		height += dotLineHeight
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %s %s" width="%s" height="%s" role="img" font-family="sans-serif" font-size="%d">`,
+		num(width), num(height), num(width), num(height), dotFontSize)
+	if g.Name != "" {
+		sb.WriteString("<title>" + html.EscapeString(dotID(g.Name)) + "</title>")
+	}
+	sb.WriteString(`<defs><marker id="` + arrowID + `" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse">` +
+		`<path d="M0,0L10,5L0,10z" fill="#333"></path></marker></defs>`)
+
+	for _, e := range edges {
+		sb.WriteString(drawDotEdge(nodes, e, g.Directed, arrowID))
+	}
+	for _, n := range nodes {
+		if !n.dummy {
+			sb.WriteString(drawDotNode(n))
+		}
+	}
+	if graphLabel != "" {
+		fmt.Fprintf(&sb, `<text x="%s" y="%s" text-anchor="middle">%s</text>`,
+			num(width/2), num(height-dotMargin), html.EscapeString(graphLabel))
+	}
+	sb.WriteString("</svg>")
+	return sb.String(), nil
+}
+
+// drawDotNode returns the SVG for a node.
+func drawDotNode(n *dotNode) string {
+	stroke := dotColor(n.attrs, "color", "#333")
+	fill := "none"
+	style := dotAttr(n.attrs, "style")
+	if strings.Contains(style, "filled") {
+		fill = dotColor(n.attrs, "fillcolor", dotColor(n.attrs, "color", "lightgrey"))
+	}
+	common := ` fill="` + fill + `" stroke="` + stroke + `"` + dotDash(style)
+
+	var sb strings.Builder
+	sb.WriteString("<g>")
+	x, y, hw, hh := n.x, n.y, n.w/2, n.h/2
+	switch n.shape {
+	case "box", "rect", "rectangle", "square", "record", "mrecord", "Mrecord":
+		rx := "0"
+		if strings.Contains(style, "rounded") || n.shape == "Mrecord" {
+			rx = "6"
+		}
+		fmt.Fprintf(&sb, `<rect x="%s" y="%s" width="%s" height="%s" rx="%s"%s></rect>`,
+			num(x-hw), num(y-hh), num(n.w), num(n.h), rx, common)
+	case "circle", "doublecircle":
+		fmt.Fprintf(&sb, `<circle cx="%s" cy="%s" r="%s"%s></circle>`, num(x), num(y), num(hw), common)
+		if n.shape == "doublecircle" {
+			fmt.Fprintf(&sb, `<circle cx="%s" cy="%s" r="%s"%s></circle>`, num(x), num(y), num(hw-4), common)
+		}
+	case "diamond":
+		fmt.Fprintf(&sb, `<polygon points="%s,%s %s,%s %s,%s %s,%s"%s></polygon>`,
+			num(x), num(y-hh), num(x+hw), num(y), num(x), num(y+hh), num(x-hw), num(y), common)
+	case "point":
+		fmt.Fprintf(&sb, `<circle cx="%s" cy="%s" r="%s" fill="%s"></circle>`, num(x), num(y), num(hw), stroke)
+	case "plaintext", "plain", "none", "underline":
+	default:
+		fmt.Fprintf(&sb, `<ellipse cx="%s" cy="%s" rx="%s" ry="%s"%s></ellipse>`, num(x), num(y), num(hw), num(hh), common)
+	}
+	if n.shape != "point" {
+		sb.WriteString(dotText(x, y, n.lines, dotColor(n.attrs, "fontcolor", "#000"), ""))
+	}
+	sb.WriteString("</g>")
+	return sb.String()
+}
+
+// drawDotEdge returns the SVG for an edge.
+func drawDotEdge(nodes []*dotNode, e *dotEdge, directed bool, arrowID string) string {
+	stroke := dotColor(e.attrs, "color", "#333")
+	attrs := ` fill="none" stroke="` + stroke + `"` + dotDash(dotAttr(e.attrs, "style"))
+	dir := dotAttr(e.attrs, "dir")
+	if dir == "" && directed {
+		dir = "forward"
+	}
+	if dir == "forward" || dir == "both" {
+		attrs += ` marker-end="url(#` + arrowID + `)"`
+	}
+	if dir == "back" || dir == "both" {
+		attrs += ` marker-start="url(#` + arrowID + `)"`
+	}
+
+	var d string
+	var lx, ly float64 // label position
+	if e.loop {
+		n := nodes[e.path[0]]
+		x, y := n.x+n.w/2, n.y
+		d = fmt.Sprintf("M%s,%sC%s,%s %s,%s %s,%s", num(x-4), num(y-n.h/2+4),
+			num(x+30), num(y-n.h/2-10), num(x+30), num(y+n.h/2+10), num(x-4), num(y+n.h/2-4))
+		lx, ly = x+34, y
+	} else if e.offset != 0 {
+		// A quadratic curve, with its control point off to the side
+		// (the same side for either direction of the edge).
+		from, to := nodes[e.path[0]], nodes[e.path[1]]
+		if e.path[0] > e.path[1] {
+			from, to = to, from
+		}
+		a, b := [2]float64{from.x, from.y}, [2]float64{to.x, to.y}
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		l := math.Hypot(dx, dy)
+		c := [2]float64{(a[0]+b[0])/2 - dy/l*2*e.offset, (a[1]+b[1])/2 + dx/l*2*e.offset}
+		p0, p1 := dotClip(nodes[e.path[0]], c), dotClip(nodes[e.path[1]], c)
+		d = "M" + num(p0[0]) + "," + num(p0[1]) + "Q" + num(c[0]) + "," + num(c[1]) + " " + num(p1[0]) + "," + num(p1[1])
+		lx, ly = (p0[0]+2*c[0]+p1[0])/4+4, (p0[1]+2*c[1]+p1[1])/4
+	} else {
+		pts := make([][2]float64, len(e.path))
+		for i, u := range e.path {
+			pts[i] = [2]float64{nodes[u].x, nodes[u].y}
+		}
+		last := len(pts) - 1
+		pts[0] = dotClip(nodes[e.path[0]], pts[1])
+		pts[last] = dotClip(nodes[e.path[last]], pts[last-1])
+		var sb strings.Builder
+		for i, p := range pts {
+			if i == 0 {
+				sb.WriteString("M")
+			} else {
+				sb.WriteString("L")
+			}
+			sb.WriteString(num(p[0]) + "," + num(p[1]))
+		}
+		d = sb.String()
+		mid := len(pts) / 2
+		lx, ly = (pts[mid-1][0]+pts[mid][0])/2+4, (pts[mid-1][1]+pts[mid][1])/2
+	}
+
+	out := `<path d="` + d + `"` + attrs + `></path>`
+	if label := dotAttr(e.attrs, "label"); label != "" {
+		out += dotText(lx, ly, dotLabelLines(label), dotColor(e.attrs, "fontcolor", "#000"),
+			` text-anchor="start" paint-order="stroke" stroke="#fff" stroke-width="3"`)
+	}
+	return out
+}
+
+// dotClip returns where the line from the centre of the node towards p
+// meets the edge of the node.
+func dotClip(n *dotNode, p [2]float64) [2]float64 {
+	dx, dy := p[0]-n.x, p[1]-n.y
+	if n.dummy || (dx == 0 && dy == 0) {
+		return [2]float64{n.x, n.y}
+	}
+	hw, hh := n.w/2, n.h/2
+	var t float64
+	switch n.shape {
+	case "box", "rect", "rectangle", "square", "record", "mrecord", "Mrecord", "plaintext", "plain", "none", "underline":
+		t = 1 / max(math.Abs(dx)/hw, math.Abs(dy)/hh)
+	case "diamond":
+		t = 1 / (math.Abs(dx)/hw + math.Abs(dy)/hh)
+	default:
+		t = 1 / math.Sqrt(dx*dx/(hw*hw)+dy*dy/(hh*hh))
+	}
+	return [2]float64{n.x + dx*t, n.y + dy*t}
+}
+
+// dotNodeSize returns the size of a node, based on its label and shape, or
+// the width and height attributes (in inches) if larger.
+func dotNodeSize(n *dotNode) (w, h float64) {
+	chars := 0
+	for _, l := range n.lines {
+		chars = max(chars, utf8.RuneCountInString(l))
+	}
+	w = float64(chars)*0.6*dotFontSize + 24
+	h = float64(len(n.lines))*dotLineHeight + 14
+	switch n.shape {
+	case "box", "rect", "rectangle", "record", "mrecord", "Mrecord", "plaintext", "plain", "none", "underline":
+	case "square":
+		w = max(w, h)
+		h = w
+	case "circle", "doublecircle":
+		w = max(w, h)
+		if n.shape == "doublecircle" {
+			w += 8
+		}
+		h = w
+	case "diamond":
+		w, h = w*1.6, h*1.6
+	case "point":
+		return 8, 8
+	default: // ellipse
+		w, h = w*1.2, h*1.1
+	}
+	if v, err := strconv.ParseFloat(dotAttr(n.attrs, "width"), 64); err == nil {
+		w = max(w, v*72)
+	}
+	if v, err := strconv.ParseFloat(dotAttr(n.attrs, "height"), 64); err == nil {
+		h = max(h, v*72)
+	}
+	return w, h
+}
+
+// dotText returns SVG text, centred on (x, y) unless attrs says otherwise.
+func dotText(x, y float64, lines []string, fill, attrs string) string {
+	if attrs == "" {
+		attrs = ` text-anchor="middle"`
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<text fill="%s"%s>`, fill, attrs)
+	top := y - float64(len(lines)-1)*dotLineHeight/2
+	for i, l := range lines {
+		fmt.Fprintf(&sb, `<tspan x="%s" y="%s" dominant-baseline="central">%s</tspan>`,
+			num(x), num(top+float64(i)*dotLineHeight), html.EscapeString(l))
+	}
+	sb.WriteString("</text>")
+	return sb.String()
+}
+
+// dotLabelLines splits a label at \n, \l, and \r (which, in Graphviz, also
+// justify the line - that is ignored).
+func dotLabelLines(label string) []string {
+	label = strings.NewReplacer(`\l`, "\n", `\r`, "\n", `\n`, "\n").Replace(label)
+	return strings.Split(strings.TrimSuffix(label, "\n"), "\n")
+}
+
+// dotDash returns the SVG attribute for dashed or dotted lines.
+func dotDash(style string) string {
+	switch {
+	case strings.Contains(style, "dashed"):
+		return ` stroke-dasharray="5,3"`
+	case strings.Contains(style, "dotted"):
+		return ` stroke-dasharray="1,3"`
+	}
+	return ""
+}
+
+// dotColor returns an attribute that is a colour, or def if not set.
+func dotColor(attrs gographviz.Attrs, key, def string) string {
+	c := dotAttr(attrs, key)
+	if c == "" {
+		return def
+	}
+	// Only the first of a colour list is used.
+	c, _, _ = strings.Cut(c, ":")
+	return html.EscapeString(c)
+}
+
+var htmlTagRE = regexp.MustCompile(`<[^>]*>`)
+
+// dotAttr returns an attribute without any quoting.
+func dotAttr(attrs gographviz.Attrs, key string) string {
+	return dotID(attrs[gographviz.Attr(key)])
+}
+
+// dotID unquotes a DOT ID. HTML strings are reduced to their text.
+func dotID(s string) string {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		s = s[1 : len(s)-1]
+		s = strings.ReplaceAll(s, "\\\n", "")
+		return strings.ReplaceAll(s, `\"`, `"`)
+	case len(s) >= 2 && s[0] == '<' && s[len(s)-1] == '>':
+		return html.UnescapeString(htmlTagRE.ReplaceAllString(s[1:len(s)-1], ""))
+	}
+	return s
+}
+
+// num formats a coordinate for SVG.
+func num(f float64) string {
+	return strconv.FormatFloat(math.Round(f*10)/10, 'f', -1, 64)
+}
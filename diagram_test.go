@@ -0,0 +1,89 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// checkGolden compares got with the golden file, or updates the golden file
+// with -update.
+func checkGolden(t *testing.T, golden, got string) {
+	t.Helper()
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatalf("os.WriteFile(%q) = %v", golden, err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) = %v", golden, err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s (run with -update to update it):\ngot:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+// TestRenderDot renders each testdata/diagram/*.dot to SVG, and compares the
+// result with the .svg file of the same name.
+func TestRenderDot(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/diagram/*.dot")
+	if err != nil {
+		t.Fatalf("filepath.Glob() = %v", err)
+	}
+	for _, in := range inputs {
+		t.Run(filepath.Base(in), func(t *testing.T) {
+			src, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%q) = %v", in, err)
+			}
+			svg, err := renderDot(string(src))
+			if err != nil {
+				t.Fatalf("renderDot() = %v", err)
+			}
+			checkGolden(t, strings.TrimSuffix(in, ".dot")+".svg", svg+"\n")
+		})
+	}
+}
+
+// TestExtractDiagrams renders each testdata/diagram/*.md (with its diagrams)
+// to HTML, and compares the result with the .html file of the same name.
+func TestExtractDiagrams(t *testing.T) {
+	o := newOptions(nil)
+	inputs, err := filepath.Glob("testdata/diagram/*.md")
+	if err != nil {
+		t.Fatalf("filepath.Glob() = %v", err)
+	}
+	for _, in := range inputs {
+		t.Run(filepath.Base(in), func(t *testing.T) {
+			src, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%q) = %v", in, err)
+			}
+			h, err := o.renderHTML(BlackfridayRenderer(), string(src))
+			if err != nil {
+				t.Fatalf("renderHTML() = %v", err)
+			}
+			checkGolden(t, strings.TrimSuffix(in, ".md")+".html", h)
+		})
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrReadOnly is returned by read-only Stores when asked to change a Page.
+var ErrReadOnly = errors.New("store is read-only")
+
+// frontMatter is the metadata at the top of a Markdown page file, between
+// "---" lines (YAML) or "+++" lines (TOML).
+type frontMatter struct {
+	Title        string    `yaml:"title" toml:"title"`
+	Created      time.Time `yaml:"created" toml:"created"`
+	LastModified time.Time `yaml:"lastmodified" toml:"lastmodified"`
+	Published    *bool     `yaml:"published" toml:"published"`
+	Blog         bool      `yaml:"blog" toml:"blog"`
+	Category     string    `yaml:"category" toml:"category"`
+	Tags         []string  `yaml:"tags" toml:"tags"`
+	Description  string    `yaml:"description" toml:"description"`
+	Layout       string    `yaml:"layout" toml:"layout"`
+}
+
+// dirStore implements a read-only Store backed by a directory of Markdown
+// files. Each file "name.md" becomes the page with key name "name". Files are
+// reloaded when the directory changes.
+//
+// The site can be configured with a "_site.yaml" or "_site.toml" file in the
+// directory, using the lower-cased field names of Site (urlbase,
+// pagetemplate, and so on). A Server reloads its sites when the site file
+// changes. Sites written with PutSite are kept in memory only.
+type dirStore struct {
+	dir     string
+	watcher *fsnotify.Watcher
+
+	mu           sync.RWMutex
+	sites        map[string]*Site
+	pages        map[string]*Page // by key name; keys have no parent
+	listeners    map[int]func(storeChange)
+	nextListener int
+}
+
+// OpenDirStore loads Markdown pages from a directory, and watches the
+// directory for changes. Pages are served for any Site key. Front matter
+// fields map onto the Page fields of the same name; published defaults to
+// true, and lastmodified defaults to the file modification time.
+func OpenDirStore(dir string) (Store, error) {
+	d := &dirStore{
+		dir:       dir,
+		sites:     make(map[string]*Site),
+		listeners: make(map[int]func(storeChange)),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %v", err)
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("watch %q: %v", dir, err)
+	}
+	d.watcher = w
+	go watchSettled(w, dir, isContentFile, d.reload)
+	return d, nil
+}
+
+// Close stops watching the directory for changes.
+func (d *dirStore) Close() error {
+	return d.watcher.Close()
+}
+
+// isContentFile reports whether changes to the file are of interest: hidden
+// files (such as editor swap files) are not.
+func isContentFile(name string) bool {
+	return !strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// reload reloads the directory after it changes.
+func (d *dirStore) reload() {
+	if err := d.load(); err != nil {
+		log.Printf("Couldn't reload %q: %v", d.dir, err)
+	}
+}
+
+// notifyChanges calls f with the changes to the site file and pages after each
+// reload, until cancelled.
+func (d *dirStore) notifyChanges(f func(storeChange)) (cancel func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextListener
+	d.nextListener++
+	d.listeners[id] = f
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.listeners, id)
+	}
+}
+
+// changedPages returns the names of pages that differ between old and new,
+// including those that are only in one of them.
+func changedPages(old, new map[string]*Page) []string {
+	var names []string
+	for name, p := range new {
+		if o, ok := old[name]; !ok || !reflect.DeepEqual(o, p) {
+			names = append(names, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// load (re)reads every page file in the directory, and the site file if
+// present.
+func (d *dirStore) load() error {
+	ents, err := os.ReadDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("read dir: %v", err)
+	}
+	var site *Site
+	pages := make(map[string]*Page)
+	var posts []*Page
+	for _, ent := range ents {
+		name := ent.Name()
+		if ent.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(d.dir, name)
+		switch name {
+		case "_site.yaml", "_site.toml":
+			s, err := readSiteFile(path)
+			if err != nil {
+				return err
+			}
+			site = s
+			continue
+		}
+		if strings.HasPrefix(name, "_") || filepath.Ext(name) != ".md" {
+			continue
+		}
+		p, err := readPageFile(path)
+		if err != nil {
+			return err
+		}
+		pages[p.Key.Name] = p
+		if p.Published && p.Blog {
+			posts = append(posts, p)
+		}
+	}
+	sortPages(posts, "Created")
+	relinkPages(posts)
+
+	d.mu.Lock()
+	change := storeChange{pages: changedPages(d.pages, pages)}
+	d.pages = pages
+	if site != nil {
+		change.site = !reflect.DeepEqual(d.sites[""], site)
+		d.sites[""] = site
+	}
+	listeners := make([]func(storeChange), 0, len(d.listeners))
+	for _, f := range d.listeners {
+		listeners = append(listeners, f)
+	}
+	d.mu.Unlock()
+
+	if change.site || len(change.pages) > 0 {
+		for _, f := range listeners {
+			f(change)
+		}
+	}
+	return nil
+}
+
+// splitFrontMatter separates the front matter from the rest of the file. It
+// reports the delimiter used ("---" or "+++"), or "" if there is none.
+func splitFrontMatter(b []byte) (delim string, fm, rest []byte, err error) {
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		b = append(b, '\n')
+	}
+	for _, delim := range []string{"---", "+++"} {
+		if !bytes.HasPrefix(b, []byte(delim+"\n")) {
+			continue
+		}
+		b = b[len(delim):] // keep the newline, in case fm is empty
+		i := bytes.Index(b, []byte("\n"+delim+"\n"))
+		if i < 0 {
+			return "", nil, nil, errors.New("unterminated front matter")
+		}
+		return delim, b[1 : i+1], b[i+len(delim)+2:], nil
+	}
+	return "", nil, b, nil
+}
+
+func readPageFile(path string) (*Page, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+
+	var fm frontMatter
+	delim, meta, contents, err := splitFrontMatter(b)
+	switch {
+	case err != nil:
+		// Reported below.
+	case delim == "---":
+		err = yaml.Unmarshal(meta, &fm)
+	case delim == "+++":
+		err = toml.Unmarshal(meta, &fm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse front matter of %q: %v", path, err)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), ".md")
+	p := &Page{
+		Key:          datastore.NameKey("Page", name, nil),
+		Title:        fm.Title,
+		Created:      fm.Created,
+		LastModified: fm.LastModified,
+		Published:    fm.Published == nil || *fm.Published,
+		Blog:         fm.Blog,
+		Category:     fm.Category,
+		Tags:         fm.Tags,
+		Description:  fm.Description,
+		Layout:       fm.Layout,
+		Contents:     string(contents),
+	}
+	if p.LastModified.IsZero() {
+		p.LastModified = fi.ModTime()
+	}
+	if p.Created.IsZero() {
+		p.Created = p.LastModified
+	}
+	return p, nil
+}
+
+func readSiteFile(path string) (*Site, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	site := new(Site)
+	if filepath.Ext(path) == ".toml" {
+		err = toml.Unmarshal(b, site)
+	} else {
+		err = yaml.Unmarshal(b, site)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %v", path, err)
+	}
+	return site, nil
+}
+
+// withParent returns a copy of a loaded page, keyed under the site.
+func withParent(p *Page, site *datastore.Key) *Page {
+	p = clonePage(p)
+	p.Key = datastore.NameKey("Page", p.Key.Name, site)
+	if p.Prev != nil {
+		p.Prev = datastore.NameKey("Page", p.Prev.Name, site)
+	}
+	if p.Next != nil {
+		p.Next = datastore.NameKey("Page", p.Next.Name, site)
+	}
+	return p
+}
+
+func (d *dirStore) GetSite(ctx context.Context, key *datastore.Key) (*Site, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s, ok := d.sites[key.String()]
+	if !ok {
+		// Fall back to the site file, if any.
+		if s, ok = d.sites[""]; !ok {
+			return nil, ErrNotFound
+		}
+	}
+	s = cloneSite(s)
+	s.Key = key
+	return s, nil
+}
+
+func (d *dirStore) PutSite(ctx context.Context, site *Site) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sites[site.Key.String()] = cloneSite(site)
+	return nil
+}
+
+func (d *dirStore) GetPage(ctx context.Context, key *datastore.Key) (*Page, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	p, ok := d.pages[key.Name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return withParent(p, key.Parent), nil
+}
+
+func (d *dirStore) GetPages(ctx context.Context, keys []*datastore.Key) ([]*Page, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	pages := make([]*Page, len(keys))
+	for i, k := range keys {
+		if p, ok := d.pages[k.Name]; ok {
+			pages[i] = withParent(p, k.Parent)
+		}
+	}
+	return pages, nil
+}
+
+func (d *dirStore) PutPage(ctx context.Context, page *Page) error {
+	return ErrReadOnly
+}
+
+func (d *dirStore) DeletePage(ctx context.Context, key *datastore.Key) error {
+	return ErrReadOnly
+}
+
+func (d *dirStore) QueryPages(ctx context.Context, site *datastore.Key, q PageQuery) ([]*Page, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var pages []*Page
+	for _, p := range d.pages {
+		if !p.Published || (q.BlogOnly && !p.Blog) {
+			continue
+		}
+		pages = append(pages, withParent(p, site))
+	}
+	sortPages(pages, q.Order)
+	if q.Limit > 0 && len(pages) > q.Limit {
+		pages = pages[:q.Limit]
+	}
+	return pages, nil
+}
+
+// Relink does nothing, since links are computed when the files are loaded.
+func (d *dirStore) Relink(ctx context.Context, site *datastore.Key) ([]*datastore.Key, error) {
+	return nil, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(%q) = %v", path, err)
+	}
+}
+
+func TestReadPageFile(t *testing.T) {
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name, file string
+		want       *Page // only the front matter fields and Contents
+		wantErr    bool
+	}{
+		{
+			name: "yaml",
+			file: "---\ntitle: Hello\ncreated: 2020-05-01T12:00:00Z\nblog: true\ncategory: misc\ntags: [a, b]\ndescription: A page\nlayout: wide.html\n---\nContents\n",
+			want: &Page{Title: "Hello", Created: created, Published: true, Blog: true, Category: "misc", Tags: []string{"a", "b"}, Description: "A page", Layout: "wide.html", Contents: "Contents\n"},
+		},
+		{
+			name: "toml",
+			file: "+++\ntitle = \"Hello\"\ncreated = 2020-05-01T12:00:00Z\npublished = false\n+++\nContents\n",
+			want: &Page{Title: "Hello", Created: created, Contents: "Contents\n"},
+		},
+		{
+			name: "crlf",
+			file: "---\r\ntitle: Hello\r\n---\r\nContents\r\n",
+			want: &Page{Title: "Hello", Published: true, Contents: "Contents\n"},
+		},
+		{
+			name: "no front matter",
+			file: "Just contents\n",
+			want: &Page{Published: true, Contents: "Just contents\n"},
+		},
+		{
+			name:    "unterminated",
+			file:    "---\ntitle: Hello\nContents\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad yaml",
+			file:    "---\ntitle: [\n---\nContents\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "page.md")
+			writeFile(t, path, test.file)
+			p, err := readPageFile(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("readPageFile() = %+v, want error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readPageFile() = %v", err)
+			}
+			if p.Key.Name != "page" {
+				t.Errorf("Key.Name = %q, want %q", p.Key.Name, "page")
+			}
+			if p.LastModified.IsZero() {
+				t.Error("LastModified is zero, want the file modification time")
+			}
+			if test.want.Created.IsZero() {
+				test.want.Created = p.LastModified
+			}
+			got := &Page{
+				Title:       p.Title,
+				Created:     p.Created,
+				Published:   p.Published,
+				Blog:        p.Blog,
+				Category:    p.Category,
+				Tags:        p.Tags,
+				Description: p.Description,
+				Layout:      p.Layout,
+				Contents:    p.Contents,
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readPageFile() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// waitForBody gets path until the body contains want, or fails the test after
+// a while.
+func waitForBody(t *testing.T, h http.Handler, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, body := get(t, h, path)
+		if strings.Contains(body, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET %s = %q, want it to contain %q", path, body, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDirStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	site := testSite(t)
+	siteFile := "pagetemplate: " + site.PageTemplate + "\nsecret: 0123456789abcdef0123456789abcdef\ntimelocation: UTC\n"
+	writeFile(t, filepath.Join(dir, "_site.yaml"), siteFile+"feedtitle: First title\n")
+	writeFile(t, filepath.Join(dir, "hello.md"), "---\ntitle: Hello\nblog: true\n---\nFirst version\n")
+
+	s, err := New(context.Background(), "test", ContentDir(dir))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	defer s.Close()
+
+	if _, body := get(t, s, "/hello"); !strings.Contains(body, "First version") {
+		t.Fatalf("GET /hello = %q, want the first version", body)
+	}
+	if _, body := get(t, s, "/rss.xml"); !strings.Contains(body, "First title") {
+		t.Fatalf("GET /rss.xml = %q, want the first title", body)
+	}
+
+	writeFile(t, filepath.Join(dir, "hello.md"), "---\ntitle: Hello\nblog: true\n---\nSecond version\n")
+	waitForBody(t, s, "/hello", "Second version")
+
+	writeFile(t, filepath.Join(dir, "_site.yaml"), siteFile+"feedtitle: Second title\n")
+	waitForBody(t, s, "/rss.xml", "Second title")
+}
+
+func TestChangedPages(t *testing.T) {
+	page := func(contents string) *Page { return &Page{Contents: contents} }
+	old := map[string]*Page{"same": page("a"), "edited": page("b"), "removed": page("c")}
+	new := map[string]*Page{"same": page("a"), "edited": page("B"), "added": page("d")}
+	got := changedPages(old, new)
+	want := []string{"added", "edited", "removed"}
+	slices.Sort(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changedPages() = %v, want %v", got, want)
+	}
+}
@@ -82,6 +82,12 @@ var editTmpl = template.Must(template.New("edit.html").Parse(`<!DOCTYPE html>
 						<label for="Tags"{{if .Tags}} class="active"{{end}}>Tags</label>
 						<span class="helper-text">Comma-separated tag list</span>
 					</div>
+					<div class="input-field col s12">
+						<input type="text" name="Layout" value="{{.Layout}}" list="layouts">
+						<label for="Layout"{{if .Layout}} class="active"{{end}}>Layout</label>
+						<span class="helper-text">Template to render the page with; leave blank for the default</span>
+						<datalist id="layouts">{{range $.Layouts}}<option value="{{.}}">{{end}}</datalist>
+					</div>
 					<div class="input-field col s12">
 						<textarea name="Description">{{.Description}}</textarea>
 						<label for="Description"{{if .Description}} class="active"{{end}}>Description</label>
@@ -92,7 +98,7 @@ var editTmpl = template.Must(template.New("edit.html").Parse(`<!DOCTYPE html>
 						<input type="hidden" id="contents" name="Contents" value="{{.Contents}}">
 					</div>
 					<div class="col s12">
-						{{if .Key}}<a class="btn waves-effect waves-light" href="/preview/{{.Key.Name}}">Preview
+						{{if .Key}}<a class="btn waves-effect waves-light" href="{{$.Prefix}}/preview/{{.Key.Name}}">Preview
 							<i class="material-icons right">pageview</i>
 						</a>{{end}}
 						<button class="btn waves-effect waves-light" type="submit" name="action">Save
@@ -130,13 +136,18 @@ type userIDCtxKey struct{}
 type editPage struct {
 	XSRFToken string
 	Page      *Page
+	Layouts   []string
+	Prefix    string // see PathPrefix
 }
 
-func loginRedirect(to *url.URL) string {
+// loginRedirect returns the URL of the login page, which redirects back to
+// the given URL (within the site) after logging in.
+func (s *server) loginRedirect(to *url.URL) string {
+	to = &url.URL{Path: s.options.url(to.Path), RawQuery: to.RawQuery}
 	q := make(url.Values)
 	q.Set("redirect_to", to.String())
 	u := url.URL{
-		Path:     "/login",
+		Path:     s.options.url("/login"),
 		RawQuery: q.Encode(),
 	}
 	return u.String()
@@ -155,12 +166,12 @@ func (s *server) authMiddleware(next http.Handler) http.Handler {
 		sess, err := s.site.cookieStore.Get(r, "userinfo")
 		if err != nil {
 			log.Printf("cookieStore.Get(user) = error: %v", err)
-			http.Redirect(w, r, loginRedirect(r.URL), http.StatusFound)
+			http.Redirect(w, r, s.loginRedirect(r.URL), http.StatusFound)
 			return
 		}
 		userID, _ := sess.Values["user_id"].(string)
 		if userID != s.site.AdminEmail {
-			http.Redirect(w, r, loginRedirect(r.URL), http.StatusFound)
+			http.Redirect(w, r, s.loginRedirect(r.URL), http.StatusFound)
 			return
 		}
 
@@ -203,14 +214,17 @@ func (s *server) handleEditPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	key := datastore.NameKey("Page", nkey, s.site.Key)
-	page := &Page{Key: key}
-	if err := s.client.Get(ctx, key, page); err != nil {
-		if err != datastore.ErrNoSuchEntity {
+	page, err := s.store.GetPage(ctx, key)
+	if err != nil {
+		if err != ErrNotFound {
 			http.Error(w, "couldn't check for existing entity", http.StatusInternalServerError)
 			return
 		}
+		page = &Page{Key: key}
 	}
-	page.Key = key
+	// The old neighbours need purging from the cache, since their links may
+	// change.
+	stale := []*datastore.Key{key, page.Prev, page.Next}
 	page.Title = title
 	page.Contents = contents
 	page.Description = r.PostFormValue("Description")
@@ -218,28 +232,34 @@ func (s *server) handleEditPost(w http.ResponseWriter, r *http.Request) {
 	page.Blog = r.PostFormValue("Blog") == "on"
 	page.Category = r.PostFormValue("Category")
 	page.Tags = tags(r.PostFormValue("Tags"))
+	page.Layout = strings.TrimSpace(r.PostFormValue("Layout"))
 	page.LastModified = time.Now().In(s.site.timeLoc)
 	if page.Created.IsZero() && page.Published {
 		page.Created = page.LastModified
 	}
 
-	if _, err := s.client.Put(ctx, key, page); err != nil {
+	if err := s.store.PutPage(ctx, page); err != nil {
 		http.Error(w, "couldn't save entity", http.StatusInternalServerError)
 		log.Printf("Couldn't put: %v", err)
 		return
 	}
-	if err := s.relink(ctx); err != nil {
+	relinked, err := s.store.Relink(ctx, s.site.Key)
+	// Purge even if relinking failed, since the page was saved.
+	s.invalidate(append(stale, relinked...)...)
+	if err != nil {
 		http.Error(w, "couldn't relink", http.StatusInternalServerError)
 		log.Printf("Couldn't relink: %v", err)
 		return
 	}
 	if pkey != nkey {
-		http.Redirect(w, r, "/edit/"+nkey, http.StatusFound)
+		http.Redirect(w, r, s.options.url("/edit/"+nkey), http.StatusFound)
 		return
 	}
 	ed := &editPage{
 		XSRFToken: xsrftoken.Generate(s.site.Secret, userID, "edit/"+nkey),
 		Page:      page,
+		Layouts:   s.site.template().layouts(),
+		Prefix:    s.options.pathPrefix,
 	}
 	if err := editTmpl.Execute(w, ed); err != nil {
 		log.Printf("Couldn't execute editTmpl: %v", err)
@@ -254,13 +274,18 @@ func (s *server) handleEditGet(w http.ResponseWriter, r *http.Request) {
 		Page: &Page{
 			Blog: true,
 		},
+		Layouts: s.site.template().layouts(),
+		Prefix:  s.options.pathPrefix,
 	}
 	if pkey != "" {
-		ed.Page.Key = datastore.NameKey("Page", pkey, s.site.Key)
-		if err := s.client.Get(ctx, ed.Page.Key, ed.Page); err != nil {
+		key := datastore.NameKey("Page", pkey, s.site.Key)
+		p, err := s.store.GetPage(ctx, key)
+		if err != nil {
 			// Maybe I want to create such a page?
 			log.Printf("%q not found: %v", pkey, err)
+			p = &Page{Key: key, Blog: true}
 		}
+		ed.Page = p
 	}
 
 	if err := editTmpl.Execute(w, ed); err != nil {
@@ -17,23 +17,20 @@ package saebr
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/gorilla/feeds"
 )
 
 func (s *server) fetchFeed(ctx context.Context) (*feeds.Feed, error) {
-	q := datastore.NewQuery("Page").
-		Ancestor(s.site.Key).
-		FilterField("Published", "=", true).
-		FilterField("Blog", "=", true).
-		Order("-Created")
-
-	var pages []*Page
-	if _, err := s.client.GetAll(ctx, q, &pages); err != nil {
+	pages, err := s.store.QueryPages(ctx, s.site.Key, PageQuery{
+		BlogOnly: true,
+		Order:    "-Created",
+	})
+	if err != nil {
 		return nil, fmt.Errorf("fetching all posts: %v", err)
 	}
 
@@ -48,6 +45,12 @@ func (s *server) fetchFeed(ctx context.Context) (*feeds.Feed, error) {
 	}
 
 	for _, page := range pages {
+		content, err := s.options.renderFeedMarkdown(page.Contents)
+		if err != nil {
+			// Leave the page out, rather than failing the whole feed.
+			log.Printf("Couldn't render %q for feed: %v", page.Key.Name, err)
+			continue
+		}
 		if page.Created.After(feed.Updated) {
 			feed.Updated = page.Created
 		}
@@ -62,7 +65,7 @@ func (s *server) fetchFeed(ctx context.Context) (*feeds.Feed, error) {
 			Id:          link,
 			Updated:     page.LastModified,
 			Created:     page.Created,
-			Content:     string(blackfridayRun(page.Contents)),
+			Content:     string(content),
 			Description: page.Description,
 		})
 	}
@@ -73,16 +76,39 @@ type feedContent struct {
 	contentType string
 	updated     time.Time
 	method      func() (string, error)
+
+	once     sync.Once
+	rendered *rendered // result of method, or nil if it failed
 }
 
-func (c *feedContent) Render(w http.ResponseWriter, r *http.Request) {
-	x, err := c.method()
-	if err != nil {
+// output calls method (once), and returns the result.
+func (c *feedContent) output() *rendered {
+	c.once.Do(func() {
+		x, err := c.method()
+		if err != nil {
+			log.Printf("Couldn't render %s: %v", c.contentType, err)
+			return
+		}
+		c.rendered = newRendered(c.contentType, c.updated, []byte(x))
+	})
+	return c.rendered
+}
+
+// Size returns the size of the rendered feed.
+func (c *feedContent) Size() int {
+	if rd := c.output(); rd != nil {
+		return rd.Size()
+	}
+	return 0
+}
+
+func (c *feedContent) Render(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+	rd := c.output()
+	if rd == nil {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", c.contentType)
-	http.ServeContent(w, r, strings.TrimPrefix(r.URL.Path, "/"), c.updated, strings.NewReader(x))
+	rd.serve(w, r, maxAge)
 }
 
 func (s *server) fetchRSS(ctx context.Context, _ map[string]string) (content, error) {
@@ -0,0 +1,168 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/russross/blackfriday/v2"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+)
+
+// highlightable is implemented by the built-in MarkdownRenderers, which can
+// highlight fenced code blocks (see SyntaxHighlighting).
+type highlightable interface {
+	// withHighlighting returns a copy of the renderer that highlights code
+	// using the style, marking it up with CSS classes or inline styles.
+	withHighlighting(style string, classes bool) (MarkdownRenderer, error)
+}
+
+// setupHighlighting switches the Markdown renderers to ones that highlight
+// code, if SyntaxHighlighting was given.
+func (o *options) setupHighlighting() error {
+	if o.highlightStyle == "" {
+		return nil
+	}
+	hr, ok := o.markdown.(highlightable)
+	if !ok {
+		return fmt.Errorf("SyntaxHighlighting: the Markdown renderer (%T) can't highlight code", o.markdown)
+	}
+	md, err := hr.withHighlighting(o.highlightStyle, true)
+	if err != nil {
+		return fmt.Errorf("SyntaxHighlighting: %v", err)
+	}
+	feed, err := hr.withHighlighting(o.highlightStyle, false)
+	if err != nil {
+		return fmt.Errorf("SyntaxHighlighting: %v", err)
+	}
+
+	// Options given to the renderer can replace the part that highlights, so
+	// check that it does.
+	b := new(strings.Builder)
+	if err := md.Render(b, []byte("```go\npackage saebr\n```\n")); err != nil {
+		return fmt.Errorf("SyntaxHighlighting: render test code: %v", err)
+	}
+	if !strings.Contains(b.String(), `class="chroma"`) {
+		return errors.New("SyntaxHighlighting: the Markdown renderer's options prevent highlighting code")
+	}
+	o.markdown, o.feedMarkdown = md, feed
+	return nil
+}
+
+// highlighter highlights code with chroma.
+type highlighter struct {
+	style     *chroma.Style
+	formatter *chromahtml.Formatter
+}
+
+func newHighlighter(style string, classes bool) *highlighter {
+	return &highlighter{
+		style:     styles.Get(style),
+		formatter: chromahtml.New(chromahtml.WithClasses(classes)),
+	}
+}
+
+// highlight writes code in the language as highlighted HTML.
+func (h *highlighter) highlight(w io.Writer, lang, code string) error {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	return h.formatter.Format(w, h.style, it)
+}
+
+// css returns the stylesheet for the classes used by the highlighter.
+func (h *highlighter) css() []byte {
+	b := new(bytes.Buffer)
+	if err := h.formatter.WriteCSS(b, h.style); err != nil {
+		log.Printf("Couldn't write highlighting CSS: %v", err)
+	}
+	return b.Bytes()
+}
+
+// blackfridayHighlighter renders code blocks with a highlighter, and
+// everything else with Blackfriday's usual HTML renderer.
+type blackfridayHighlighter struct {
+	*blackfriday.HTMLRenderer
+	hl *highlighter
+}
+
+func (b blackfridayHighlighter) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type != blackfriday.CodeBlock {
+		return b.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	lang, _, _ := strings.Cut(string(node.Info), " ")
+	buf := new(bytes.Buffer)
+	if err := b.hl.highlight(buf, lang, string(node.Literal)); err != nil {
+		log.Printf("Couldn't highlight %q code: %v", lang, err)
+		return b.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	w.Write(buf.Bytes())
+	return blackfriday.GoToNext
+}
+
+func (b blackfridayRenderer) withHighlighting(style string, classes bool) (MarkdownRenderer, error) {
+	r := blackfridayHighlighter{
+		HTMLRenderer: blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+			Flags: blackfriday.CommonHTMLFlags,
+		}),
+		hl: newHighlighter(style, classes),
+	}
+	// Any renderer in the existing options takes precedence.
+	opts := append([]blackfriday.Option{blackfriday.WithRenderer(r)}, b.opts...)
+	return blackfridayRenderer{opts: opts}, nil
+}
+
+func (g goldmarkRenderer) withHighlighting(style string, classes bool) (MarkdownRenderer, error) {
+	// Highlighting is added to the renderer, which is shared if it was given
+	// in the options.
+	if goldmark.New(g.opts...).Renderer() == goldmark.New(g.opts...).Renderer() {
+		return nil, errors.New("can't add highlighting to a renderer given with goldmark.WithRenderer")
+	}
+	opts := append(g.opts[:len(g.opts):len(g.opts)], goldmark.WithExtensions(
+		highlighting.NewHighlighting(
+			highlighting.WithStyle(style),
+			highlighting.WithFormatOptions(chromahtml.WithClasses(classes)),
+		),
+	))
+	return goldmarkRenderer{md: goldmark.New(opts...), opts: opts}, nil
+}
+
+// highlightCSSPath is where the stylesheet for highlighted code is served.
+const highlightCSSPath = "/highlight.css"
+
+// highlightCSS returns a handler serving the stylesheet for highlighted code.
+func highlightCSS(style string, maxAge time.Duration) http.Handler {
+	rd := newRendered("text/css; charset=utf-8", time.Now(), newHighlighter(style, true).css())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rd.serve(w, r, maxAge)
+	})
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"io"
+	"testing"
+
+	"github.com/russross/blackfriday/v2"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+type plainRenderer struct{}
+
+func (plainRenderer) Render(w io.Writer, source []byte) error {
+	_, err := w.Write(source)
+	return err
+}
+
+func TestSetupHighlighting(t *testing.T) {
+	tests := []struct {
+		name    string
+		md      MarkdownRenderer
+		wantErr bool
+	}{
+		{"blackfriday", BlackfridayRenderer(), false},
+		{"blackfriday with extensions", BlackfridayRenderer(blackfriday.WithExtensions(blackfriday.CommonExtensions)), false},
+		{"blackfriday with renderer", BlackfridayRenderer(blackfriday.WithRenderer(blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{}))), true},
+		{"goldmark", GoldmarkRenderer(), false},
+		{"goldmark with renderer", GoldmarkRenderer(goldmark.WithRenderer(renderer.NewRenderer(
+			renderer.WithNodeRenderers(util.Prioritized(goldmarkhtml.NewRenderer(), 1000)),
+		))), true},
+		{"custom", plainRenderer{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newOptions([]Option{Markdown(test.md), SyntaxHighlighting("github")})
+			err := o.setupHighlighting()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("setupHighlighting() = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -26,28 +26,27 @@ import (
 var (
 	indexTmpl = template.Must(template.New("index.md").Parse(`All blog posts, in reverse chronological order.
 
-{{range .}}#### {{.Header}}
+{{range .Groups}}#### {{.Header}}
 {{range .Pages}}
-[{{.Title}}](/{{.Key.Name}}){{if .Edited}} <small>(edited {{.LastModified.Format "January 2006"}})</small>{{end}}{{if .Description}}<br />{{.Description}}{{end}}
+[{{.Title}}]({{$.Prefix}}/{{.Key.Name}}){{if .Edited}} <small>(edited {{.LastModified.Format "January 2006"}})</small>{{end}}{{if .Description}}<br />{{.Description}}{{end}}
 
 {{end}}
 {{end}}`))
 )
 
 func (s *server) fetchIndex(ctx context.Context, _ map[string]string) (content, error) {
-	q := datastore.NewQuery("Page").
-		Ancestor(s.site.Key).
-		FilterField("Published", "=", true).
-		FilterField("Blog", "=", true).
-		Order("-Created")
-
-	var pages []*Page
-	if _, err := s.client.GetAll(ctx, q, &pages); err != nil {
+	pages, err := s.store.QueryPages(ctx, s.site.Key, PageQuery{
+		BlogOnly: true,
+		Order:    "-Created",
+	})
+	if err != nil {
 		return nil, fmt.Errorf("fetching all posts: %v", err)
 	}
 	if len(pages) == 0 {
 		return sitePage{
-			site: s.site,
+			svr:    s,
+			path:   pathFrom(ctx),
+			layout: indexLayout,
 			page: &Page{
 				Key:         datastore.NameKey("Page", "index", s.site.Key),
 				Title:       "Index",
@@ -81,11 +80,17 @@ func (s *server) fetchIndex(ctx context.Context, _ map[string]string) (content,
 	}
 
 	b := new(strings.Builder)
-	if err := indexTmpl.Execute(b, groups); err != nil {
+	data := struct {
+		Prefix string // see PathPrefix
+		Groups []*pageGroup
+	}{s.options.pathPrefix, groups}
+	if err := indexTmpl.Execute(b, data); err != nil {
 		return nil, fmt.Errorf("execute index template: %v", err)
 	}
 	return sitePage{
-		site: s.site,
+		svr:    s,
+		path:   pathFrom(ctx),
+		layout: indexLayout,
 		page: &Page{
 			Key:          datastore.NameKey("Page", "index", s.site.Key),
 			Title:        "Index",
@@ -18,39 +18,43 @@ import (
 	"context"
 	"errors"
 	"net/http"
-
-	"cloud.google.com/go/datastore"
 )
 
-// Fetches the latest blog post.
-func (s *server) fetchLatest(ctx context.Context, _ map[string]string) (content, error) {
-	q := datastore.NewQuery("Page").
-		Ancestor(s.site.Key).
-		FilterField("Published", "=", true).
-		FilterField("Blog", "=", true).
-		Order("-Created").
-		Limit(1)
+var errNoPosts = errors.New("no pages returned")
 
-	var pages []*Page
-	if _, err := s.client.GetAll(ctx, q, &pages); err != nil {
+// latestPost returns the latest blog post. With keysOnly, only its Key is
+// needed (see PageQuery).
+func (s *server) latestPost(ctx context.Context, keysOnly bool) (*Page, error) {
+	pages, err := s.store.QueryPages(ctx, s.site.Key, PageQuery{
+		BlogOnly: true,
+		Order:    "-Created",
+		Limit:    1,
+		KeysOnly: keysOnly,
+	})
+	if err != nil {
 		return nil, err
 	}
 	if len(pages) == 0 {
-		return nil, errors.New("no pages returned")
+		return nil, errNoPosts
+	}
+	return pages[0], nil
+}
+
+// Fetches the latest blog post.
+func (s *server) fetchLatest(ctx context.Context, _ map[string]string) (content, error) {
+	p, err := s.latestPost(ctx, false)
+	if err != nil {
+		return nil, err
 	}
-	return sitePage{
-		site: s.site,
-		page: pages[0],
-	}, nil
+	return s.newSitePage(ctx, p)
 }
 
 // Redirects to the latest blog post.
 func (s *server) redirectToLatest(w http.ResponseWriter, r *http.Request) {
-	latest, err := s.fetchLatest(r.Context(), nil)
+	latest, err := s.latestPost(r.Context(), true)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	sp := latest.(sitePage)
-	http.Redirect(w, r, "/"+sp.page.Key.Name, http.StatusFound)
+	http.Redirect(w, r, s.options.url("/"+latest.Key.Name), http.StatusFound)
 }
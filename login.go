@@ -139,5 +139,5 @@ func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, redir, http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/edit", http.StatusFound)
+	http.Redirect(w, r, s.options.url("/edit"), http.StatusFound)
 }
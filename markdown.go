@@ -0,0 +1,363 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// MarkdownRenderer converts Markdown to HTML. It is used for page contents
+// (via the "markdown" template function), feeds, and the index.
+type MarkdownRenderer interface {
+	Render(w io.Writer, source []byte) error
+}
+
+type blackfridayRenderer struct {
+	opts []blackfriday.Option
+}
+
+// BlackfridayRenderer returns a MarkdownRenderer using Blackfriday with the
+// given options. With no options, it uses Blackfriday's common extensions.
+// This is the default renderer.
+func BlackfridayRenderer(opts ...blackfriday.Option) MarkdownRenderer {
+	return blackfridayRenderer{opts: opts}
+}
+
+func (b blackfridayRenderer) Render(w io.Writer, source []byte) error {
+	_, err := w.Write(blackfriday.Run(source, b.opts...))
+	return err
+}
+
+type goldmarkRenderer struct {
+	md   goldmark.Markdown
+	opts []goldmark.Option
+}
+
+// DefaultGoldmarkOptions returns the options GoldmarkRenderer uses if none
+// are given: CommonMark plus tables, strikethrough, autolinks, task lists,
+// footnotes, typographic punctuation, and automatic heading IDs. Raw HTML in
+// the Markdown is passed through, as Blackfriday does.
+func DefaultGoldmarkOptions() []goldmark.Option {
+	return []goldmark.Option{
+		goldmark.WithExtensions(
+			extension.Table,
+			extension.Strikethrough,
+			extension.Linkify,
+			extension.TaskList,
+			extension.Footnote,
+			extension.Typographer,
+		),
+		goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+	}
+}
+
+// GoldmarkRenderer returns a MarkdownRenderer using goldmark (which is
+// CommonMark compliant) with the given options, or DefaultGoldmarkOptions if
+// none are given.
+func GoldmarkRenderer(opts ...goldmark.Option) MarkdownRenderer {
+	if len(opts) == 0 {
+		opts = DefaultGoldmarkOptions()
+	}
+	return goldmarkRenderer{md: goldmark.New(opts...), opts: opts}
+}
+
+func (g goldmarkRenderer) Render(w io.Writer, source []byte) error {
+	ctx := parser.NewContext(parser.WithIDs(&slugIDs{used: make(map[string]bool)}))
+	return g.md.Convert(source, w, parser.WithContext(ctx))
+}
+
+// slugIDs implements parser.IDs, so that goldmark's automatic heading IDs are
+// the same as those generated for other renderers (see addHeadingIDs). The
+// headings still contain placeholders at this point, which are left out.
+type slugIDs struct {
+	used map[string]bool
+}
+
+var placeholderRE = regexp.MustCompile(`SAEBRPLACEHOLDER\d+X`)
+
+func (s *slugIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	base := slugify(string(placeholderRE.ReplaceAll(value, nil)))
+	id := base
+	for n := 1; s.used[id]; n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	s.used[id] = true
+	return []byte(id)
+}
+
+func (s *slugIDs) Put(value []byte) {
+	s.used[string(value)] = true
+}
+
+// renderMarkdown converts Markdown to HTML using the configured renderer.
+func (o *options) renderMarkdown(s string) (template.HTML, error) {
+	h, _, err := o.render(o.markdown, s)
+	return h, err
+}
+
+// renderFeedMarkdown converts Markdown to HTML for feeds. This differs from
+// renderMarkdown with SyntaxHighlighting, and leaves out preview-only parts.
+func (o *options) renderFeedMarkdown(s string) (template.HTML, error) {
+	h, _, err := o.render(o.feedMarkdown, s)
+	return template.HTML(stripPreviewOnly([]byte(h))), err
+}
+
+// render converts Markdown to HTML with the renderer, then gives the headings
+// IDs, and replaces the TOC marker (if any) with the table of contents.
+func (o *options) render(r MarkdownRenderer, s string) (template.HTML, []*TOCEntry, error) {
+	h, err := o.renderHTML(r, s)
+	if err != nil {
+		return "", nil, err
+	}
+	out, toc := addHeadingIDs(h)
+	if o.tocMarker != "" {
+		marker := "<p>" + html.EscapeString(o.tocMarker) + "</p>"
+		out = strings.ReplaceAll(out, marker, string(tocHTML(toc)))
+	}
+	return template.HTML(out), toc, nil
+}
+
+// renderHTML expands shortcodes, diagrams, and math, and converts Markdown to
+// HTML with the renderer. Shortcodes rendering Markdown themselves come back here.
+func (o *options) renderHTML(r MarkdownRenderer, s string) (string, error) {
+	s, expanded := o.expandShortcodes(s, func(inner string) (template.HTML, error) {
+		h, err := o.renderHTML(r, inner)
+		return template.HTML(h), err
+	})
+	s, expanded = extractDiagrams(s, expanded)
+	if !o.mathDisabled {
+		s, expanded = extractMath(s, expanded)
+	}
+	b := new(strings.Builder)
+	if err := r.Render(b, []byte(s)); err != nil {
+		return "", err
+	}
+	return replacePlaceholders(b.String(), expanded), nil
+}
+
+// Parts of the output only shown when previewing are marked with these, and
+// removed by stripPreviewOnly otherwise.
+const (
+	previewOnlyStart = "<!--preview-only-->"
+	previewOnlyEnd   = "<!--/preview-only-->"
+)
+
+var previewOnlyRE = regexp.MustCompile(`(?s)` + previewOnlyStart + `.*?` + previewOnlyEnd)
+
+// stripPreviewOnly removes the parts of HTML only shown when previewing.
+func stripPreviewOnly(b []byte) []byte {
+	if !bytes.Contains(b, []byte(previewOnlyStart)) {
+		return b
+	}
+	return previewOnlyRE.ReplaceAll(b, nil)
+}
+
+// previewError returns an error box for something in the contents that
+// couldn't be rendered, shown only when previewing.
+func previewError(what string, err error) string {
+	return previewOnlyStart + `<div class="card-panel red lighten-4 render-error"><strong>` +
+		html.EscapeString(what) + `:</strong> ` + html.EscapeString(err.Error()) + `</div>` + previewOnlyEnd
+}
+
+// placeholder is substituted for shortcodes and math before Markdown
+// rendering, and replaced by their output afterwards, so the output is
+// untouched by the Markdown renderer. It is plain letters and digits so that
+// no renderer changes it, and ends in X so that no placeholder is a prefix of
+// another.
+func placeholder(i int) string {
+	return "SAEBRPLACEHOLDER" + strconv.Itoa(i) + "X"
+}
+
+// replacePlaceholders replaces placeholders in rendered HTML with what they
+// stand for. Placeholders in paragraphs of their own replace the whole
+// paragraph, since the output is usually block-level.
+func replacePlaceholders(s string, subs []template.HTML) string {
+	for i := range subs {
+		ph := placeholder(i)
+		s = strings.ReplaceAll(s, "<p>"+ph+"</p>", string(subs[i]))
+		s = strings.ReplaceAll(s, ph, string(subs[i]))
+	}
+	return s
+}
+
+// nextLine returns the first line of s, including the newline.
+func nextLine(s string) string {
+	if n := strings.IndexByte(s, '\n'); n >= 0 {
+		return s[:n+1]
+	}
+	return s
+}
+
+// openingFence returns the fence (``` or ~~~, or longer) and info string of
+// a line opening a fenced code block, or "" if the line doesn't open one.
+func openingFence(line string) (fence, info string) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) >= 4 || !(strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")) {
+		return "", ""
+	}
+	rest := strings.TrimLeft(trimmed, trimmed[:1])
+	fence = trimmed[:len(trimmed)-len(rest)]
+	info = strings.TrimSpace(rest)
+	if fence[0] == '`' && strings.Contains(info, "`") {
+		return "", ""
+	}
+	return fence, info
+}
+
+// closesFence reports whether the line closes a fenced code block opened
+// with the fence.
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	return len(line)-len(trimmed) < 4 && strings.HasPrefix(trimmed, fence) &&
+		strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])) == ""
+}
+
+// mdBlocks follows the block structure of Markdown line by line, well enough
+// to tell which lines are in code blocks or raw HTML blocks, and so must be
+// left alone by anything rewriting the Markdown.
+type mdBlocks struct {
+	fence      string // of the fenced code block we're in, if any
+	htmlEnd    string // ends the HTML block we're in ("\n" for a blank line), if any
+	indentCode bool   // in an indented code block
+	para       bool   // the previous line was paragraph text
+	listIndent int    // the content indent of the list we're in, or 0
+}
+
+// Raw HTML blocks starting with these end with the matching closing tag,
+// rather than at a blank line.
+var htmlBlockEnds = []struct{ start, end string }{
+	{"<pre", "</pre>"},
+	{"<script", "</script>"},
+	{"<style", "</style>"},
+	{"<textarea", "</textarea>"},
+	{"<!--", "-->"},
+	{"<?", "?>"},
+	{"<![CDATA[", "]]>"},
+	{"<!", ">"},
+}
+
+// Matches the start of a line starting a raw HTML block: a tag (but not an
+// autolink), comment, processing instruction, or declaration.
+var htmlBlockStartRE = regexp.MustCompile(`^<(?:/?[A-Za-z][A-Za-z0-9-]*(?:[\s/>]|$)|[!?])`)
+
+var listItemRE = regexp.MustCompile(`^ {0,3}(?:[-+*]|\d{1,9}[.)])( +|$)`)
+
+// verbatim is called with each line in turn, and reports whether the line is
+// in a code block or raw HTML block.
+func (b *mdBlocks) verbatim(line string) bool {
+	blank := strings.TrimSpace(line) == ""
+	switch {
+	case b.fence != "":
+		if closesFence(line, b.fence) {
+			b.fence = ""
+		}
+		return true
+	case b.htmlEnd != "":
+		if b.htmlEnd == "\n" && blank {
+			b.htmlEnd = ""
+			b.para = false
+			return false
+		}
+		if strings.Contains(strings.ToLower(line), b.htmlEnd) {
+			b.htmlEnd = ""
+		}
+		return true
+	case blank:
+		b.para = false
+		return b.indentCode
+	}
+
+	indent := indentWidth(line)
+	if b.indentCode && indent >= 4+b.listIndent {
+		return true
+	}
+	b.indentCode = false
+	if indent >= 4+b.listIndent && !b.para {
+		b.indentCode = true
+		return true
+	}
+	if indent < b.listIndent && !b.para {
+		b.listIndent = 0
+	}
+	if indent >= 4 {
+		// Continues a paragraph or list item.
+		b.para = true
+		return false
+	}
+
+	trimmed := strings.TrimLeft(line, " \t")
+	if fence, _ := openingFence(line); fence != "" {
+		b.fence = fence
+		b.para = false
+		return true
+	}
+	if m := listItemRE.FindStringSubmatch(line); m != nil {
+		b.listIndent = len(m[0])
+		if m[1] == "" || len(m[1]) > 4 {
+			b.listIndent = len(m[0]) - len(m[1]) + 1
+		}
+		b.para = true
+		return false
+	}
+	if strings.HasPrefix(trimmed, "<") && len(trimmed) > 1 && !b.para {
+		if htmlBlockStartRE.MatchString(trimmed) {
+			b.htmlEnd = "\n"
+			lower := strings.ToLower(trimmed)
+			for _, e := range htmlBlockEnds {
+				if strings.HasPrefix(lower, e.start) {
+					b.htmlEnd = e.end
+					break
+				}
+			}
+			if b.htmlEnd != "\n" && strings.Contains(lower[1:], b.htmlEnd) {
+				b.htmlEnd = ""
+			}
+			return true
+		}
+	}
+	b.para = !strings.HasPrefix(trimmed, "#")
+	return false
+}
+
+// indentWidth returns the width of the indentation of a line, with tabs
+// stopping at multiples of 4.
+func indentWidth(line string) int {
+	w := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			w++
+		case '\t':
+			w += 4 - w%4
+		default:
+			return w
+		}
+	}
+	return w
+}
@@ -0,0 +1,799 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// extractMath replaces $inline$ and $$display$$ math in Markdown contents
+// with placeholders, appending the MathML for each to subs. Math in code
+// spans, code blocks (fenced or indented), and raw HTML blocks is left alone,
+// as is \$.
+//
+// As in Pandoc, an opening $ must be followed by a non-space, and a closing $
+// must follow a non-space and not be followed by a digit, so that "$5 and
+// $10" is not math.
+func extractMath(src string, subs []template.HTML) (string, []template.HTML) {
+	var out strings.Builder
+	var blocks mdBlocks
+	lineStart := true
+	for i := 0; i < len(src); {
+		if lineStart {
+			line := nextLine(src[i:])
+			if blocks.verbatim(line) {
+				out.WriteString(line)
+				i += len(line)
+				continue
+			}
+			lineStart = false
+		}
+
+		switch c := src[i]; c {
+		case '\n':
+			lineStart = true
+		case '\\':
+			if i+1 < len(src) {
+				out.WriteString(src[i : i+2])
+				i += 2
+				continue
+			}
+		case '`':
+			// Code span: skip to the matching run of backticks.
+			n := len(src[i:]) - len(strings.TrimLeft(src[i:], "`"))
+			run := src[i : i+n]
+			end := strings.Index(src[i+n:], run)
+			if end < 0 {
+				out.WriteString(run)
+				i += n
+				continue
+			}
+			out.WriteString(src[i : i+n+end+n])
+			i += n + end + n
+			continue
+		case '$':
+			tex, display, n := matchMath(src[i:])
+			if n == 0 {
+				break
+			}
+			out.WriteString(placeholder(len(subs)))
+			subs = append(subs, texToMathML(tex, display))
+			i += n
+			continue
+		}
+		out.WriteByte(src[i])
+		i++
+	}
+	return out.String(), subs
+}
+
+// matchMath matches math at the start of s, which starts with $. It returns
+// the TeX, whether it is display math, and the length of the match (0 if
+// there is no match).
+func matchMath(s string) (tex string, display bool, n int) {
+	if strings.HasPrefix(s, "$$") {
+		end := strings.Index(s[2:], "$$")
+		if end < 0 || strings.TrimSpace(s[2:2+end]) == "" {
+			return "", false, 0
+		}
+		return strings.TrimSpace(s[2 : 2+end]), true, 2 + end + 2
+	}
+	if len(s) < 2 || unicode.IsSpace(rune(s[1])) {
+		return "", false, 0
+	}
+	for j := 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '\n':
+			if j+1 < len(s) && s[j+1] == '\n' {
+				// Math doesn't span paragraphs.
+				return "", false, 0
+			}
+		case '$':
+			if unicode.IsSpace(rune(s[j-1])) || (j+1 < len(s) && s[j+1] >= '0' && s[j+1] <= '9') {
+				continue
+			}
+			return s[1:j], false, j + 1
+		}
+	}
+	return "", false, 0
+}
+
+// texToMathML converts TeX math to MathML. Anything it doesn't understand is
+// marked up as an error, rather than failing the whole page.
+func texToMathML(tex string, display bool) template.HTML {
+	p := &texParser{src: tex, display: display}
+	body := p.parseExpr("")
+	if p.pos < len(p.src) {
+		p.fail("unexpected %q", p.src[p.pos:])
+		body += merror(p.src[p.pos:])
+	}
+	if p.err != nil {
+		log.Printf("Math %q: %v", tex, p.err)
+	}
+	attr := ""
+	if display {
+		attr = ` display="block"`
+	}
+	return template.HTML(`<math xmlns="http://www.w3.org/1998/Math/MathML"` + attr + `><semantics>` +
+		mrow(body) + `<annotation encoding="application/x-tex">` + html.EscapeString(tex) + `</annotation>` +
+		`</semantics></math>`)
+}
+
+type texTokenKind int
+
+const (
+	texEOF     texTokenKind = iota
+	texCommand              // \name, or \ and one non-letter
+	texNumber               // digits, possibly with a decimal point
+	texLetter               // one letter
+	texChar                 // anything else
+)
+
+type texToken struct {
+	kind texTokenKind
+	text string // without the backslash, for commands
+}
+
+// texParser is a recursive descent parser for (most of) the math subset of
+// TeX commonly used in posts, producing MathML Core.
+type texParser struct {
+	src     string
+	pos     int
+	display bool
+	variant string // set by \mathbb etc.
+	envs    int    // depth of \begin...\end environments
+	err     error  // first error encountered
+}
+
+func (p *texParser) fail(format string, args ...any) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (p *texParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *texParser) next() texToken {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return texToken{kind: texEOF}
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '\\':
+		p.pos++
+		for p.pos < len(p.src) && isASCIILetter(p.src[p.pos]) {
+			p.pos++
+		}
+		if p.pos == start+1 && p.pos < len(p.src) {
+			p.pos++ // \, \{ \\ etc
+		}
+		return texToken{kind: texCommand, text: p.src[start+1 : p.pos]}
+	case c >= '0' && c <= '9':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		return texToken{kind: texNumber, text: p.src[start:p.pos]}
+	}
+	r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += n
+	if unicode.IsLetter(r) {
+		return texToken{kind: texLetter, text: string(r)}
+	}
+	return texToken{kind: texChar, text: string(r)}
+}
+
+func (p *texParser) peek() texToken {
+	pos := p.pos
+	t := p.next()
+	p.pos = pos
+	return t
+}
+
+// atStop reports whether the next token ends an expression: a closing brace,
+// or something only meaningful to an enclosing construct.
+func (p *texParser) atStop(stop string) bool {
+	t := p.peek()
+	switch t.kind {
+	case texEOF:
+		return true
+	case texChar:
+		return t.text == "}" || t.text == "&" && p.envs > 0 || (stop != "" && t.text == stop)
+	case texCommand:
+		return t.text == "\\" && p.envs > 0 || t.text == "right" || t.text == "end" || t.text == "middle" && stop == "right"
+	}
+	return false
+}
+
+// parseExpr parses atoms up to the end of the expression (see atStop).
+func (p *texParser) parseExpr(stop string) string {
+	var sb strings.Builder
+	for !p.atStop(stop) {
+		sb.WriteString(p.parseAtom())
+	}
+	return sb.String()
+}
+
+// parseAtom parses something with optional subscripts and superscripts.
+func (p *texParser) parseAtom() string {
+	base, limits := p.parseBase()
+	var sub, sup string
+	hasSup := false // sup has more than primes
+	for {
+		switch t := p.peek(); {
+		case t.kind == texChar && t.text == "_" && sub == "":
+			p.next()
+			sub = p.parseArg()
+		case t.kind == texChar && t.text == "^" && !hasSup:
+			// As in TeX, x'^2 is x^{\prime 2}.
+			p.next()
+			sup += p.parseArg()
+			hasSup = true
+		case t.kind == texChar && t.text == "'":
+			p.next()
+			if hasSup {
+				p.fail("double superscript")
+				sup += merror("'")
+				break
+			}
+			sup += "<mo>′</mo>"
+		case t.kind == texCommand && (t.text == "limits" || t.text == "nolimits"):
+			p.next()
+			limits = t.text == "limits"
+		default:
+			if sup != "" {
+				sup = mrow(sup)
+			}
+			switch {
+			case sub != "" && sup != "":
+				if limits {
+					return "<munderover>" + base + sub + sup + "</munderover>"
+				}
+				return "<msubsup>" + base + sub + sup + "</msubsup>"
+			case sub != "":
+				if limits {
+					return "<munder>" + base + sub + "</munder>"
+				}
+				return "<msub>" + base + sub + "</msub>"
+			case sup != "":
+				if limits {
+					return "<mover>" + base + sup + "</mover>"
+				}
+				return "<msup>" + base + sup + "</msup>"
+			}
+			return base
+		}
+	}
+}
+
+// parseArg parses the argument of a command, or a script: a group, or a
+// single token.
+func (p *texParser) parseArg() string {
+	t := p.peek()
+	switch {
+	case t.kind == texEOF || t.kind == texChar && (t.text == "}" || t.text == "&"):
+		p.fail("missing argument")
+		return merror("?")
+	case t.kind == texNumber:
+		// Only the first digit: x^23 is x² followed by 3.
+		p.skipSpace()
+		p.pos++
+		return "<mn>" + p.styled(t.text[:1]) + "</mn>"
+	}
+	base, _ := p.parseBase()
+	return base
+}
+
+// parseGroup parses the contents of braces, after the opening brace.
+func (p *texParser) parseGroup() string {
+	body := p.parseExpr("")
+	if t := p.peek(); t.kind != texChar || t.text != "}" {
+		p.fail("missing }")
+		return mrow(body + merror("}"))
+	}
+	p.next()
+	return mrow(body)
+}
+
+// parseBase parses one thing that scripts can be attached to. limits is true
+// if the scripts of the thing go above and below it.
+func (p *texParser) parseBase() (mathml string, limits bool) {
+	t := p.next()
+	switch t.kind {
+	case texNumber:
+		return "<mn>" + p.styled(t.text) + "</mn>", false
+	case texLetter:
+		return p.mi(t.text), false
+	case texCommand:
+		return p.parseCommand(t.text)
+	case texChar:
+		switch t.text {
+		case "{":
+			return p.parseGroup(), false
+		case "~":
+			return `<mspace width="0.2778em"></mspace>`, false
+		case "^", "_":
+			p.fail("unexpected %s", t.text)
+			return merror(t.text), false
+		}
+		if op, ok := texCharOps[t.text]; ok {
+			return mo(op), false
+		}
+		if r, _ := utf8.DecodeRuneInString(t.text); unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return p.mi(t.text), false
+		}
+		return mo(html.EscapeString(t.text)), false
+	}
+	return "", false
+}
+
+// parseCommand parses what follows \name.
+func (p *texParser) parseCommand(name string) (string, bool) {
+	if s, ok := texIdentifiers[name]; ok {
+		if r, _ := utf8.DecodeRuneInString(s); unicode.IsUpper(r) {
+			return `<mi mathvariant="normal">` + s + "</mi>", false
+		}
+		return "<mi>" + s + "</mi>", false
+	}
+	if s, ok := texOperators[name]; ok {
+		return mo(s), false
+	}
+	if s, ok := texBigOperators[name]; ok {
+		return mo(s), !strings.Contains(name, "int")
+	}
+	if texFunctions[name] {
+		return "<mi>" + name + "</mi>", p.display && texLimitFunctions[name]
+	}
+	if w, ok := texSpaces[name]; ok {
+		return `<mspace width="` + w + `"></mspace>`, false
+	}
+	if a, ok := texAccents[name]; ok {
+		return `<mover accent="true">` + p.parseArg() + `<mo stretchy="` + fmt.Sprint(strings.HasPrefix(name, "wide") || strings.HasPrefix(name, "over")) + `">` + a + "</mo></mover>", false
+	}
+	if v, ok := texVariants[name]; ok {
+		saved := p.variant
+		p.variant = v
+		arg := p.parseArg()
+		p.variant = saved
+		return arg, false
+	}
+	if sz, ok := texDelimiterSizes[name]; ok {
+		return `<mo minsize="` + sz + `" maxsize="` + sz + `">` + p.delimiter() + "</mo>", false
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArg()
+		return "<mfrac>" + num + p.parseArg() + "</mfrac>", false
+	case "binom":
+		top := p.parseArg()
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + top + p.parseArg() + `</mfrac><mo>)</mo></mrow>`, false
+	case "sqrt":
+		if t := p.peek(); t.kind == texChar && t.text == "[" {
+			p.next()
+			index := p.parseExpr("]")
+			p.next()
+			return "<mroot>" + p.parseArg() + mrow(index) + "</mroot>", false
+		}
+		return "<msqrt>" + p.parseArg() + "</msqrt>", false
+	case "text", "textrm", "textit", "textbf", "mbox", "hbox":
+		return "<mtext>" + html.EscapeString(p.rawArg()) + "</mtext>", false
+	case "operatorname":
+		limits := false
+		if t := p.peek(); t.kind == texChar && t.text == "*" {
+			p.next()
+			limits = p.display
+		}
+		return "<mi>" + html.EscapeString(p.rawArg()) + "</mi>", limits
+	case "underline":
+		return `<munder accentunder="true">` + p.parseArg() + `<mo stretchy="true">_</mo></munder>`, false
+	case "overbrace":
+		return `<mover accent="true">` + p.parseArg() + `<mo stretchy="true">⏞</mo></mover>`, true
+	case "underbrace":
+		return `<munder accentunder="true">` + p.parseArg() + `<mo stretchy="true">⏟</mo></munder>`, true
+	case "overset", "stackrel":
+		over := p.parseArg()
+		return "<mover>" + p.parseArg() + over + "</mover>", false
+	case "underset":
+		under := p.parseArg()
+		return "<munder>" + p.parseArg() + under + "</munder>", false
+	case "not":
+		if t := p.peek(); t.kind == texCommand || t.kind == texChar {
+			base, _ := p.parseBase()
+			return strings.Replace(base, "</mo>", "̸</mo>", 1), false
+		}
+		return mo("/"), false
+	case "left":
+		d := p.delimiter()
+		body := p.parseExpr("right")
+		for p.peek().text == "middle" {
+			p.next()
+			body += `<mo stretchy="true">` + p.delimiter() + "</mo>" + p.parseExpr("right")
+		}
+		if t := p.peek(); t.kind != texCommand || t.text != "right" {
+			p.fail(`missing \right`)
+			return mrow(fence(d) + body + merror(`\right`)), false
+		}
+		p.next()
+		return "<mrow>" + fence(d) + body + fence(p.delimiter()) + "</mrow>", false
+	case "begin":
+		return p.parseEnvironment(p.rawArg()), false
+	case "bmod", "mod":
+		return "<mo lspace=\"0.2222em\" rspace=\"0.2222em\">mod</mo>", false
+	case "pmod":
+		return `<mrow><mspace width="0.4444em"></mspace><mo>(</mo><mi>mod</mi><mspace width="0.3333em"></mspace>` + p.parseArg() + `<mo>)</mo></mrow>`, false
+	case "displaystyle", "textstyle", "scriptstyle", "nonumber", "notag", "limits", "nolimits":
+		return "", false
+	case "label", "tag":
+		p.rawArg()
+		return "", false
+	}
+	p.fail(`unknown command \%s`, name)
+	return merror(`\` + name), false
+}
+
+// parseEnvironment parses the contents of \begin{name}, and the \end{name}.
+func (p *texParser) parseEnvironment(name string) string {
+	open, closing := "", ""
+	align := ""
+	switch strings.TrimSuffix(name, "*") {
+	case "matrix", "smallmatrix":
+	case "pmatrix":
+		open, closing = "(", ")"
+	case "bmatrix":
+		open, closing = "[", "]"
+	case "Bmatrix":
+		open, closing = "{", "}"
+	case "vmatrix":
+		open, closing = "|", "|"
+	case "Vmatrix":
+		open, closing = "‖", "‖"
+	case "cases":
+		open = "{"
+		align = "left"
+	case "aligned", "align", "split", "gathered", "gather", "alignat", "eqnarray":
+		align = "right left"
+	case "array":
+		p.rawArg() // column spec
+	default:
+		p.fail("unknown environment %q", name)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<mtable")
+	if align != "" {
+		sb.WriteString(` columnalign="` + align + `"`)
+	}
+	if align == "right left" {
+		sb.WriteString(` displaystyle="true"`)
+	}
+	sb.WriteString("><mtr><mtd>")
+	p.envs++
+	defer func() { p.envs-- }()
+	for {
+		sb.WriteString(mrow(p.parseExpr("")))
+		t := p.next()
+		switch {
+		case t.kind == texChar && t.text == "&":
+			sb.WriteString("</mtd><mtd>")
+			continue
+		case t.kind == texCommand && t.text == "\\":
+			if p.peek().text == "end" {
+				continue
+			}
+			sb.WriteString("</mtd></mtr><mtr><mtd>")
+			continue
+		case t.kind == texCommand && t.text == "end":
+			if end := p.rawArg(); end != name {
+				p.fail(`\begin{%s} ended by \end{%s}`, name, end)
+			}
+		default:
+			p.fail(`missing \end{%s}`, name)
+			if t.kind == texChar && t.text == "}" {
+				p.pos-- // leave it for the enclosing group
+			}
+		}
+		break
+	}
+	sb.WriteString("</mtd></mtr></mtable>")
+
+	table := sb.String()
+	if open == "" && closing == "" {
+		return table
+	}
+	return "<mrow>" + fence(open) + table + fence(closing) + "</mrow>"
+}
+
+// rawArg returns the contents of the braced argument without parsing it, or
+// the next character if there are no braces.
+func (p *texParser) rawArg() string {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		p.fail("missing argument")
+		return ""
+	}
+	if p.src[p.pos] != '{' {
+		_, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += n
+		return p.src[p.pos-n : p.pos]
+	}
+	depth := 0
+	for i := p.pos; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				s := p.src[p.pos+1 : i]
+				p.pos = i + 1
+				return s
+			}
+		}
+	}
+	p.fail("missing }")
+	s := p.src[p.pos+1:]
+	p.pos = len(p.src)
+	return s
+}
+
+// delimiter parses the delimiter after \left, \right, \big, etc. It returns
+// "" for the empty delimiter ".".
+func (p *texParser) delimiter() string {
+	t := p.next()
+	switch t.kind {
+	case texChar:
+		if t.text == "." {
+			return ""
+		}
+		if op, ok := texCharOps[t.text]; ok {
+			return op
+		}
+		return html.EscapeString(t.text)
+	case texCommand:
+		if s, ok := texOperators[t.text]; ok {
+			return s
+		}
+	}
+	p.fail("bad delimiter %q", t.text)
+	return ""
+}
+
+// mi returns an identifier, styled according to the current variant.
+func (p *texParser) mi(s string) string {
+	if p.variant == "normal" {
+		return `<mi mathvariant="normal">` + html.EscapeString(s) + "</mi>"
+	}
+	return "<mi>" + p.styled(html.EscapeString(s)) + "</mi>"
+}
+
+// styled converts letters and digits to the Mathematical Alphanumeric
+// Symbols for the current variant (MathML Core doesn't support most values
+// of mathvariant).
+func (p *texParser) styled(s string) string {
+	if p.variant == "" || p.variant == "normal" {
+		return s
+	}
+	return strings.Map(func(r rune) rune { return mathAlphanumeric(p.variant, r) }, s)
+}
+
+func mathAlphanumeric(variant string, r rune) rune {
+	if ex, ok := mathAlphanumericExceptions[variant][r]; ok {
+		return ex
+	}
+	base, ok := mathAlphanumericBases[variant]
+	if !ok {
+		return r
+	}
+	switch {
+	case r >= 'A' && r <= 'Z':
+		return base[0] + r - 'A'
+	case r >= 'a' && r <= 'z':
+		return base[1] + r - 'a'
+	case r >= '0' && r <= '9' && base[2] != 0:
+		return base[2] + r - '0'
+	}
+	return r
+}
+
+// mathAlphanumericBases are the code points of A, a, and 0 in each variant.
+var mathAlphanumericBases = map[string][3]rune{
+	"bold":          {0x1D400, 0x1D41A, 0x1D7CE},
+	"italic":        {0x1D434, 0x1D44E, 0},
+	"bold-italic":   {0x1D468, 0x1D482, 0},
+	"script":        {0x1D49C, 0x1D4B6, 0},
+	"fraktur":       {0x1D504, 0x1D51E, 0},
+	"double-struck": {0x1D538, 0x1D552, 0x1D7D8},
+	"sans-serif":    {0x1D5A0, 0x1D5BA, 0x1D7E2},
+	"monospace":     {0x1D670, 0x1D68A, 0x1D7F6},
+}
+
+// mathAlphanumericExceptions are letters encoded outside the Mathematical
+// Alphanumeric Symbols block, because they were already in Unicode.
+var mathAlphanumericExceptions = map[string]map[rune]rune{
+	"italic": {'h': 'ℎ'},
+	"script": {
+		'B': 'ℬ', 'E': 'ℰ', 'F': 'ℱ', 'H': 'ℋ', 'I': 'ℐ', 'L': 'ℒ', 'M': 'ℳ',
+		'R': 'ℛ', 'e': 'ℯ', 'g': 'ℊ', 'o': 'ℴ',
+	},
+	"fraktur":       {'C': 'ℭ', 'H': 'ℌ', 'I': 'ℑ', 'R': 'ℜ', 'Z': 'ℨ'},
+	"double-struck": {'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ'},
+}
+
+func mrow(s string) string {
+	if isSingleElement(s) {
+		return s
+	}
+	return "<mrow>" + s + "</mrow>"
+}
+
+// isSingleElement reports whether the MathML is one element (which may have
+// children), such as <mi>x</mi> or <mrow>...</mrow>.
+func isSingleElement(s string) bool {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '<' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '/' {
+			depth--
+			if depth == 0 {
+				end := strings.IndexByte(s[i:], '>')
+				return end >= 0 && i+end+1 == len(s)
+			}
+			continue
+		}
+		if depth == 0 && i > 0 {
+			return false
+		}
+		depth++
+	}
+	return false
+}
+
+func mo(s string) string {
+	return "<mo>" + s + "</mo>"
+}
+
+func fence(d string) string {
+	if d == "" {
+		return ""
+	}
+	return `<mo fence="true" stretchy="true">` + d + "</mo>"
+}
+
+func merror(s string) string {
+	return "<merror><mtext>" + html.EscapeString(s) + "</mtext></merror>"
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Ordinary characters that are operators. Most stand for themselves.
+var texCharOps = map[string]string{
+	"+": "+", "-": "−", "=": "=", "<": "&lt;", ">": "&gt;", "*": "∗",
+	"(": "(", ")": ")", "[": "[", "]": "]", "|": "|", "/": "/",
+	",": ",", ";": ";", ":": ":", "!": "!", "?": "?", ".": ".",
+}
+
+var texIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ",
+	"varepsilon": "ε", "zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ",
+	"iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ",
+	"pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ",
+	"varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ", "varphi": "φ",
+	"chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+	"Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ",
+	"Omega": "Ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "hbar": "ℏ", "ell": "ℓ",
+	"emptyset": "∅", "varnothing": "∅", "aleph": "ℵ", "Re": "ℜ", "Im": "ℑ",
+	"wp": "℘", "top": "⊤", "bot": "⊥", "angle": "∠", "triangle": "△",
+	"imath": "ı", "jmath": "ȷ",
+	"#": "#", "%": "%", "&": "&amp;", "_": "_", "$": "$",
+}
+
+var texOperators = map[string]string{
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗",
+	"star": "⋆", "circ": "∘", "bullet": "∙", "oplus": "⊕", "ominus": "⊖",
+	"otimes": "⊗", "odot": "⊙", "cap": "∩", "cup": "∪", "setminus": "∖",
+	"wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨", "neg": "¬", "lnot": "¬",
+	"forall": "∀", "exists": "∃", "nexists": "∄", "sqcup": "⊔", "sqcap": "⊓",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅",
+	"propto": "∝", "ll": "≪", "gg": "≫", "prec": "≺", "succ": "≻",
+	"preceq": "⪯", "succeq": "⪰", "subset": "⊂", "subseteq": "⊆",
+	"supset": "⊃", "supseteq": "⊇", "in": "∈", "notin": "∉", "ni": "∋",
+	"mid": "∣", "nmid": "∤", "parallel": "∥", "perp": "⊥", "models": "⊨",
+	"vdash": "⊢", "dashv": "⊣", "coloneqq": "≔", "doteq": "≐",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←",
+	"leftrightarrow": "↔", "Rightarrow": "⇒", "Leftarrow": "⇐",
+	"Leftrightarrow": "⇔", "implies": "⟹", "impliedby": "⟸", "iff": "⟺",
+	"mapsto": "↦", "longrightarrow": "⟶", "longleftarrow": "⟵",
+	"longmapsto": "⟼", "uparrow": "↑", "downarrow": "↓", "hookrightarrow": "↪",
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋",
+	"lceil": "⌈", "rceil": "⌉", "vert": "|", "lvert": "|", "rvert": "|",
+	"Vert": "‖", "lVert": "‖", "rVert": "‖", "|": "‖", "{": "{", "}": "}",
+	"lbrace": "{", "rbrace": "}", "backslash": "\\", "colon": ":",
+	"ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱",
+	"prime": "′", "lt": "&lt;", "gt": "&gt;",
+}
+
+// Big operators; scripts go above and below, except on integrals.
+var texBigOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "int": "∫", "iint": "∬",
+	"iiint": "∭", "oint": "∮", "bigcup": "⋃", "bigcap": "⋂",
+	"bigoplus": "⨁", "bigotimes": "⨂", "bigodot": "⨀", "bigvee": "⋁",
+	"bigwedge": "⋀", "bigsqcup": "⨆",
+}
+
+var texFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true,
+	"csc": true, "arcsin": true, "arccos": true, "arctan": true, "sinh": true,
+	"cosh": true, "tanh": true, "coth": true, "log": true, "lg": true,
+	"ln": true, "exp": true, "lim": true, "limsup": true, "liminf": true,
+	"max": true, "min": true, "sup": true, "inf": true, "arg": true,
+	"det": true, "dim": true, "gcd": true, "deg": true, "hom": true,
+	"ker": true, "Pr": true,
+}
+
+// Functions whose subscripts go underneath in display math.
+var texLimitFunctions = map[string]bool{
+	"lim": true, "limsup": true, "liminf": true, "max": true, "min": true,
+	"sup": true, "inf": true, "det": true, "gcd": true, "Pr": true,
+}
+
+var texSpaces = map[string]string{
+	",": "0.1667em", ":": "0.2222em", ">": "0.2222em", ";": "0.2778em",
+	" ": "0.3333em", "quad": "1em", "qquad": "2em", "!": "-0.1667em",
+	"\\": "0em", // line breaks outside environments are ignored
+}
+
+var texAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "¯", "overline": "¯", "vec": "→",
+	"overrightarrow": "→", "overleftarrow": "←", "tilde": "~",
+	"widetilde": "~", "dot": "˙", "ddot": "¨", "check": "ˇ", "breve": "˘",
+	"acute": "´", "grave": "`",
+}
+
+var texVariants = map[string]string{
+	"mathrm": "normal", "mathbf": "bold",
+	"boldsymbol": "bold-italic", "bm": "bold-italic", "mathit": "italic",
+	"mathbb": "double-struck", "mathcal": "script", "mathscr": "script",
+	"mathfrak": "fraktur", "mathsf": "sans-serif", "mathtt": "monospace",
+}
+
+var texDelimiterSizes = map[string]string{
+	"big": "1.2em", "bigl": "1.2em", "bigr": "1.2em", "bigm": "1.2em",
+	"Big": "1.8em", "Bigl": "1.8em", "Bigr": "1.8em", "Bigm": "1.8em",
+	"bigg": "2.4em", "biggl": "2.4em", "biggr": "2.4em", "biggm": "2.4em",
+	"Bigg": "3em", "Biggl": "3em", "Biggr": "3em", "Biggm": "3em",
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// mathBodyRE matches the MathML produced by texToMathML, capturing the part
+// between <semantics> and <annotation>.
+var mathBodyRE = regexp.MustCompile(`^<math [^>]*><semantics>(.*)<annotation encoding="application/x-tex">.*</annotation></semantics></math>$`)
+
+func TestTeXToMathML(t *testing.T) {
+	tests := []struct {
+		name, tex, want string
+	}{
+		// Scripts
+		{"sub", `x_i`, `<msub><mi>x</mi><mi>i</mi></msub>`},
+		{"sup", `x^2`, `<msup><mi>x</mi><mn>2</mn></msup>`},
+		{"sup one digit", `x^23`, `<mrow><msup><mi>x</mi><mn>2</mn></msup><mn>3</mn></mrow>`},
+		{"subsup", `x_i^2`, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`},
+		{"supsub", `x^2_i`, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`},
+		{"group", `e^{i\pi}`, `<msup><mi>e</mi><mrow><mi>i</mi><mi>π</mi></mrow></msup>`},
+		{"limits", `\sum_{i=1}^n i`, `<mrow><munderover><mo>∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover><mi>i</mi></mrow>`},
+		{"double sup", `x^2^3`, `<mrow><msup><mi>x</mi><mn>2</mn></msup><merror><mtext>^</mtext></merror><mn>3</mn></mrow>`},
+		{"missing script", `x^`, `<msup><mi>x</mi><merror><mtext>?</mtext></merror></msup>`},
+
+		// Primes
+		{"prime", `f'`, `<msup><mi>f</mi><mo>′</mo></msup>`},
+		{"primes", `f''`, `<msup><mi>f</mi><mrow><mo>′</mo><mo>′</mo></mrow></msup>`},
+		{"prime then sup", `x'^2`, `<msup><mi>x</mi><mrow><mo>′</mo><mn>2</mn></mrow></msup>`},
+		{"prime and sub", `x'_i`, `<msubsup><mi>x</mi><mi>i</mi><mo>′</mo></msubsup>`},
+		{"prime after sup", `x^2'`, `<msup><mi>x</mi><mrow><mn>2</mn><merror><mtext>&#39;</mtext></merror></mrow></msup>`},
+
+		// Fractions
+		{"frac", `\frac{a}{b}`, `<mfrac><mi>a</mi><mi>b</mi></mfrac>`},
+		{"frac digits", `\frac12`, `<mfrac><mn>1</mn><mn>2</mn></mfrac>`},
+		{"frac nested", `\frac{1}{x^2}`, `<mfrac><mn>1</mn><msup><mi>x</mi><mn>2</mn></msup></mfrac>`},
+		{"frac missing arg", `\frac{a}`, `<mfrac><mi>a</mi><merror><mtext>?</mtext></merror></mfrac>`},
+
+		// Escapes
+		{"braces", `a\{b\}`, `<mrow><mi>a</mi><mo>{</mo><mi>b</mi><mo>}</mo></mrow>`},
+		{"dollar", `\$5`, `<mrow><mi>$</mi><mn>5</mn></mrow>`},
+		{"less than", `a<b`, `<mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi></mrow>`},
+		{"unknown command", `\foo`, `<merror><mtext>\foo</mtext></merror>`},
+
+		// Unbalanced
+		{"missing close brace", `{a`, `<mrow><mi>a</mi><merror><mtext>}</mtext></merror></mrow>`},
+		{"extra close brace", `a}`, `<mrow><mi>a</mi><merror><mtext>}</mtext></merror></mrow>`},
+		{"missing right", `\left( x`, `<mrow><mo fence="true" stretchy="true">(</mo><mi>x</mi><merror><mtext>\right</mtext></merror></mrow>`},
+		{"left right", `\left( x \right)`, `<mrow><mo fence="true" stretchy="true">(</mo><mi>x</mi><mo fence="true" stretchy="true">)</mo></mrow>`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(texToMathML(test.tex, false))
+			m := mathBodyRE.FindStringSubmatch(got)
+			if m == nil {
+				t.Fatalf("texToMathML(%q) = %q, not wrapped in <math><semantics>", test.tex, got)
+			}
+			if m[1] != test.want {
+				t.Errorf("texToMathML(%q) =\n%s\nwant\n%s", test.tex, m[1], test.want)
+			}
+		})
+	}
+}
+
+func TestExtractMath(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      []string // TeX of the math found, in order
+	}{
+		{"inline", `a $x$ b`, []string{`x`}},
+		{"display", "$$\nx^2\n$$", []string{`x^2`}},
+		{"money", `$5 and $10`, nil},
+		{"space after opening", `$ x$`, nil},
+		{"digit after closing", `$x$5`, nil},
+		{"escaped dollar", `\$x$ and $y$`, []string{`y`}},
+		{"escape inside", `$a\$b$`, []string{`a\$b`}},
+		{"code span", "`$x$` $y$", []string{`y`}},
+		{"fenced code", "```\n$x$\n```\n$y$", []string{`y`}},
+		{"indented code", "para $a$\n\n    x=$FOO$BAR\n\nafter $b$", []string{`a`, `b`}},
+		{"indented continuation", "para\n    $a$", []string{`a`}},
+		{"list continuation", "- item\n\n  more $a$\n\n      code $b$", []string{`a`}},
+		{"html block", "<div>\n$a$\n</div>\n\n$b$", []string{`b`}},
+		{"pre block", "<pre>\n\n$a$\n</pre>\n$b$", []string{`b`}},
+		{"html comment", "<!-- $a$ -->\n$b$", []string{`b`}},
+		{"autolink", "<https://example.com> $a$", []string{`a`}},
+		{"unclosed", `$x`, nil},
+		{"across paragraphs", "$x\n\ny$", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, subs := extractMath(test.src, nil)
+			if len(subs) != len(test.want) {
+				t.Fatalf("extractMath(%q) = %q with %d math, want %d", test.src, s, len(subs), len(test.want))
+			}
+			for i, want := range test.want {
+				if !strings.Contains(s, placeholder(i)) {
+					t.Errorf("extractMath(%q) = %q, missing placeholder %d", test.src, s, i)
+				}
+				if got, want := subs[i], texToMathML(want, strings.HasPrefix(test.src, "$$")); got != want {
+					t.Errorf("extractMath(%q) math %d = %q, want %q", test.src, i, got, want)
+				}
+			}
+			if len(test.want) == 0 && s != test.src {
+				t.Errorf("extractMath(%q) = %q, want unchanged", test.src, s)
+			}
+		})
+	}
+}
+
+func TestReplacePlaceholders(t *testing.T) {
+	subs := make([]template.HTML, 11)
+	for i := range subs {
+		subs[i] = template.HTML("<b>" + string(rune('a'+i)) + "</b>")
+	}
+	got := replacePlaceholders("<p>"+placeholder(1)+"</p>"+placeholder(10)+placeholder(0), subs)
+	if want := "<b>b</b><b>k</b><b>a</b>"; got != want {
+		t.Errorf("replacePlaceholders = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// memStore implements Store in memory. Nothing is persisted.
+type memStore struct {
+	mu    sync.RWMutex
+	sites map[string]*Site
+	pages map[string]*Page
+}
+
+// NewMemStore returns a new, empty, in-memory Store. It is intended for tests
+// and local development.
+func NewMemStore() Store {
+	return &memStore{
+		sites: make(map[string]*Site),
+		pages: make(map[string]*Page),
+	}
+}
+
+// cloneSite copies the stored fields of a Site.
+func cloneSite(s *Site) *Site {
+	return &Site{
+		Key:               s.Key,
+		URLBase:           s.URLBase,
+		PageTemplate:      s.PageTemplate,
+		TemplateDir:       s.TemplateDir,
+		AdminEmail:        s.AdminEmail,
+		Secret:            s.Secret,
+		WebSignInClientID: s.WebSignInClientID,
+		FeedTitle:         s.FeedTitle,
+		FeedSubtitle:      s.FeedSubtitle,
+		FeedDescription:   s.FeedDescription,
+		FeedAuthor:        s.FeedAuthor,
+		FeedCopyright:     s.FeedCopyright,
+		TimeLocation:      s.TimeLocation,
+	}
+}
+
+// clonePage copies the stored fields of a Page.
+func clonePage(p *Page) *Page {
+	return &Page{
+		Key:          p.Key,
+		Title:        p.Title,
+		Created:      p.Created,
+		LastModified: p.LastModified,
+		Published:    p.Published,
+		Blog:         p.Blog,
+		Category:     p.Category,
+		Tags:         append([]string(nil), p.Tags...),
+		Layout:       p.Layout,
+		Description:  p.Description,
+		Contents:     p.Contents,
+		Prev:         p.Prev,
+		Next:         p.Next,
+	}
+}
+
+func (m *memStore) GetSite(ctx context.Context, key *datastore.Key) (*Site, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sites[key.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneSite(s), nil
+}
+
+func (m *memStore) PutSite(ctx context.Context, site *Site) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sites[site.Key.String()] = cloneSite(site)
+	return nil
+}
+
+func (m *memStore) GetPage(ctx context.Context, key *datastore.Key) (*Page, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.pages[key.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clonePage(p), nil
+}
+
+func (m *memStore) GetPages(ctx context.Context, keys []*datastore.Key) ([]*Page, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pages := make([]*Page, len(keys))
+	for i, k := range keys {
+		if p, ok := m.pages[k.String()]; ok {
+			pages[i] = clonePage(p)
+		}
+	}
+	return pages, nil
+}
+
+func (m *memStore) PutPage(ctx context.Context, page *Page) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages[page.Key.String()] = clonePage(page)
+	return nil
+}
+
+func (m *memStore) DeletePage(ctx context.Context, key *datastore.Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pages, key.String())
+	return nil
+}
+
+func (m *memStore) QueryPages(ctx context.Context, site *datastore.Key, q PageQuery) ([]*Page, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pages := m.query(site, q)
+	for i, p := range pages {
+		if q.KeysOnly || q.TimesOnly {
+			pages[i] = projectPage(p, q)
+			continue
+		}
+		pages[i] = clonePage(p)
+	}
+	return pages, nil
+}
+
+func (m *memStore) Relink(ctx context.Context, site *datastore.Key) ([]*datastore.Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The query returns the stored pages themselves, so relinkPages updates
+	// them in place.
+	changed := relinkPages(m.query(site, PageQuery{BlogOnly: true, Order: "Created"}))
+	return pageKeys(changed), nil
+}
+
+// query returns the stored pages matching the query, without copying them.
+// The caller must hold m.mu.
+func (m *memStore) query(site *datastore.Key, q PageQuery) []*Page {
+	var pages []*Page
+	for _, p := range m.pages {
+		if !p.Key.Parent.Equal(site) || !p.Published {
+			continue
+		}
+		if q.BlogOnly && !p.Blog {
+			continue
+		}
+		pages = append(pages, p)
+	}
+	sortPages(pages, q.Order)
+	if q.Limit > 0 && len(pages) > q.Limit {
+		pages = pages[:q.Limit]
+	}
+	return pages
+}
+
+// sortPages sorts pages the way Datastore would for the given order: by
+// Created (ascending for "Created", descending for "-Created"), and then by
+// key.
+func sortPages(pages []*Page, order string) {
+	sort.Slice(pages, func(i, j int) bool {
+		a, b := pages[i], pages[j]
+		switch order {
+		case "Created":
+			if !a.Created.Equal(b.Created) {
+				return a.Created.Before(b.Created)
+			}
+		case "-Created":
+			if !a.Created.Equal(b.Created) {
+				return a.Created.After(b.Created)
+			}
+		}
+		return a.Key.Name < b.Key.Name
+	})
+}
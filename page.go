@@ -15,11 +15,11 @@
 package saebr
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,10 +27,22 @@ import (
 	"cloud.google.com/go/datastore"
 )
 
-var notFoundPage = &Page{
-	Key:      datastore.NameKey("Page", "notfound", nil),
-	Title:    "Error 404",
-	Contents: "#### That URL makes no sense to me\n\n###### Sorry\n\nYou might want to click one of the menu items above, or check the URL and try again.",
+var errNotPublished = errors.New("not published")
+
+// isNotFound reports whether an error from a fetcher means that the content
+// doesn't exist (as opposed to some other problem fetching it).
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, errNotPublished) || errors.Is(err, errNoPosts)
+}
+
+// newNotFoundPage returns a new page for 404 errors. Each site needs its own,
+// since the rendered HTML is kept in the Page.
+func newNotFoundPage() *Page {
+	return &Page{
+		Key:      datastore.NameKey("Page", "notfound", nil),
+		Title:    "Error 404",
+		Contents: "#### That URL makes no sense to me\n\n###### Sorry\n\nYou might want to click one of the menu items above, or check the URL and try again.",
+	}
 }
 
 // Page is the type of each blog post or page.
@@ -46,9 +58,11 @@ type Page struct {
 	Description  string         `datastore:",noindex"`
 	Contents     string         `datastore:",noindex"`
 	Prev, Next   *datastore.Key `datastore:",noindex"`
+	Layout       string         `datastore:",noindex"` // template name; "" for the default
 
-	fullHTML string    `datastore:"-"` // Set by Render
-	render   sync.Once `datastore:"-"`
+	renderMu     sync.Mutex    `datastore:"-"`
+	rendered     *rendered     `datastore:"-"` // Set by Render
+	renderedWith *pageTemplate `datastore:"-"` // template used for rendered
 }
 
 // Edited reports if the created and last-modified timestamps are different
@@ -68,69 +82,135 @@ func (p *Page) TagList() string {
 }
 
 type sitePage struct {
-	site *Site
-	page *Page
+	svr      *server
+	page     *Page
+	path     string // URL path the page is served at
+	prev     *PageSummary
+	next     *PageSummary
+	layout   string // default layout, if not chosen by whether page is Blog
+	notFound bool   // serve with status 404
+	preview  bool   // include preview-only parts, such as diagram errors
+}
+
+// layouts returns the names of the layouts to try, in order, for rendering
+// the page.
+func (sp sitePage) layouts() []string {
+	var names []string
+	if l := sp.page.Layout; l != "" {
+		names = append(names, l, l+".html")
+	}
+	switch {
+	case sp.notFound:
+		names = append(names, notFoundLayout)
+	case sp.layout != "":
+		names = append(names, sp.layout)
+	case sp.page.Blog:
+		names = append(names, postLayout)
+	default:
+		names = append(names, pageLayout)
+	}
+	return names
+}
+
+// output executes the page template for the page, and returns the result.
+// The result is kept until the template is reloaded, except for previews. It
+// returns nil if the template failed.
+func (sp sitePage) output() *rendered {
+	if sp.page == nil {
+		return nil
+	}
+	pt := sp.svr.site.template()
+	if sp.preview {
+		return sp.execute(pt)
+	}
+	sp.page.renderMu.Lock()
+	defer sp.page.renderMu.Unlock()
+	if sp.page.renderedWith == pt {
+		return sp.page.rendered
+	}
+	sp.page.rendered, sp.page.renderedWith = sp.execute(pt), pt
+	return sp.page.rendered
+}
+
+// execute executes the page template for the page, or returns nil if the
+// template failed.
+func (sp sitePage) execute(pt *pageTemplate) *rendered {
+	b := new(bytes.Buffer)
+	if err := pt.layout(sp.layouts()...).Execute(b, sp.pageContext()); err != nil {
+		sp.svr.site.templateExecError(err)
+		return nil
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	out := b.Bytes()
+	if !sp.preview {
+		out = stripPreviewOnly(out)
+	}
+	rd := newRendered("text/html; charset=utf-8", maxTime(sp.page.LastModified, pt.mtime), out)
+	rd.notFound = sp.notFound
+	return rd
+}
+
+// Size returns the size of the rendered page.
+func (sp sitePage) Size() int {
+	if sp.page == nil {
+		return 0
+	}
+	if rd := sp.output(); rd != nil {
+		return rd.Size()
+	}
+	return 0
 }
 
 // Render renders a page.
-func (sp sitePage) Render(w http.ResponseWriter, r *http.Request) {
+func (sp sitePage) Render(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
 	if sp.page == nil {
-		sp.page = notFoundPage
+		sp.page, sp.notFound = newNotFoundPage(), true
 	}
-	sp.page.render.Do(func() {
-		b := new(strings.Builder)
-		if err := sp.site.pageTmpl.Execute(b, sp.page); err != nil {
-			log.Printf("Couldn't execute template: %v", err)
-		}
-		sp.page.fullHTML = b.String()
-	})
-	if sp.page.fullHTML == "" {
+	rd := sp.output()
+	if rd == nil {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	if sp.page == notFoundPage {
-		w.Header().Set("Content-Length", strconv.Itoa(len(sp.page.fullHTML)))
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(sp.page.fullHTML))
-		return
-	}
-	http.ServeContent(w, r, "f.html", maxTime(sp.page.LastModified, sp.site.pageTmplMtime), strings.NewReader(sp.page.fullHTML))
+	rd.serve(w, r, maxAge)
 }
 
 func (s *server) fetchFixed(pageKey string) fetcherFunc {
 	return func(ctx context.Context, _ map[string]string) (content, error) {
-		key := datastore.NameKey("Page", pageKey, s.site.Key)
-		p := new(Page)
-		if err := s.client.Get(ctx, key, p); err != nil {
-			return nil, fmt.Errorf("get %q from Datastore: %v", pageKey, err)
+		p, err := s.store.GetPage(ctx, datastore.NameKey("Page", pageKey, s.site.Key))
+		if err != nil {
+			return nil, fmt.Errorf("get %q from store: %w", pageKey, err)
 		}
 		if !p.Published {
-			return nil, fmt.Errorf("%q not published", pageKey)
+			return nil, fmt.Errorf("%q %w", pageKey, errNotPublished)
 		}
-		return sitePage{site: s.site, page: p}, nil
+		return s.newSitePage(ctx, p)
 	}
 }
 
 func (s *server) fetchPage(ctx context.Context, vars map[string]string) (content, error) {
 	page := vars["page"]
-	key := datastore.NameKey("Page", page, s.site.Key)
-	p := new(Page)
-	if err := s.client.Get(ctx, key, p); err != nil {
-		return nil, fmt.Errorf("get %q from Datastore: %v", page, err)
+	p, err := s.store.GetPage(ctx, datastore.NameKey("Page", page, s.site.Key))
+	if err != nil {
+		return nil, fmt.Errorf("get %q from store: %w", page, err)
 	}
 	if !p.Published {
-		return nil, fmt.Errorf("%q not published", page)
+		return nil, fmt.Errorf("%q %w", page, errNotPublished)
 	}
-	return sitePage{site: s.site, page: p}, nil
+	return s.newSitePage(ctx, p)
 }
 
 func (s *server) fetchDraftPage(ctx context.Context, vars map[string]string) (content, error) {
 	page := vars["page"]
-	key := datastore.NameKey("Page", page, s.site.Key)
-	p := new(Page)
-	if err := s.client.Get(ctx, key, p); err != nil {
-		return nil, fmt.Errorf("get %q from Datastore: %v", page, err)
+	p, err := s.store.GetPage(ctx, datastore.NameKey("Page", page, s.site.Key))
+	if err != nil {
+		return nil, fmt.Errorf("get %q from store: %w", page, err)
+	}
+	sp, err := s.newSitePage(ctx, p)
+	if err != nil {
+		return nil, err
 	}
-	return sitePage{site: s.site, page: p}, nil
+	sp.preview = true
+	return sp, nil
 }
@@ -0,0 +1,243 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// PageContext is what page templates are executed with. It embeds the Page,
+// so templates written for a bare *Page (using {{.Title}}, {{.Key.Name}},
+// and so on) keep working.
+//
+// The methods that look things up in the store (RecentPosts and SiteTags)
+// only do so if the template uses them. Since rendered pages are cached,
+// what they return can be up to one cache TTL out of date.
+type PageContext struct {
+	*Page
+
+	// Site describes the site the page belongs to.
+	Site SiteInfo
+
+	// Path is the URL path the page is served at (without any query). The
+	// root path ("/") may serve a copy of another page, so this can differ
+	// from the page's own path.
+	Path string
+
+	// CanonicalURL is the preferred full URL of the page, or empty for the
+	// "not found" page.
+	CanonicalURL string
+
+	// PrevPage and NextPage summarise the previous and next posts, if the
+	// page is a blog post and they exist.
+	PrevPage, NextPage *PageSummary
+
+	svr *server
+
+	tocOnce sync.Once
+	toc     []*TOCEntry
+	tocErr  error
+}
+
+// SiteInfo is the public information about a site, for use in templates.
+// Unlike Site, it has nothing secret (such as the Secret, or AdminEmail).
+type SiteInfo struct {
+	URLBase         string
+	FeedTitle       string
+	FeedSubtitle    string
+	FeedDescription string
+	FeedAuthor      string
+	FeedCopyright   string
+	TimeLocation    string
+}
+
+func siteInfo(s *Site) SiteInfo {
+	return SiteInfo{
+		URLBase:         s.URLBase,
+		FeedTitle:       s.FeedTitle,
+		FeedSubtitle:    s.FeedSubtitle,
+		FeedDescription: s.FeedDescription,
+		FeedAuthor:      s.FeedAuthor,
+		FeedCopyright:   s.FeedCopyright,
+		TimeLocation:    s.TimeLocation,
+	}
+}
+
+// PageSummary is a brief description of a page, such as a neighbouring post.
+type PageSummary struct {
+	Key          *datastore.Key
+	Title        string
+	Created      time.Time
+	LastModified time.Time
+	Description  string
+}
+
+func summarise(p *Page) *PageSummary {
+	if p == nil {
+		return nil
+	}
+	return &PageSummary{
+		Key:          p.Key,
+		Title:        p.Title,
+		Created:      p.Created,
+		LastModified: p.LastModified,
+		Description:  p.Description,
+	}
+}
+
+// newSitePage returns the content for serving a page. For blog posts, the
+// neighbouring posts are fetched (together) so the template can describe
+// them.
+func (s *server) newSitePage(ctx context.Context, p *Page) (sitePage, error) {
+	sp := sitePage{svr: s, page: p, path: pathFrom(ctx)}
+	if !p.Blog || (p.Prev == nil && p.Next == nil) {
+		return sp, nil
+	}
+	var keys []*datastore.Key
+	for _, k := range []*datastore.Key{p.Prev, p.Next} {
+		if k != nil {
+			keys = append(keys, k)
+		}
+	}
+	ns, err := s.store.GetPages(ctx, keys)
+	if err != nil {
+		return sitePage{}, fmt.Errorf("get neighbours of %q from store: %v", p.Key.Name, err)
+	}
+	if p.Prev != nil {
+		sp.prev, ns = summarise(ns[0]), ns[1:]
+	}
+	if p.Next != nil {
+		sp.next = summarise(ns[0])
+	}
+	return sp, nil
+}
+
+// pathKey is the context key for the path content is being fetched for.
+type pathKey struct{}
+
+// withPath returns a context carrying the path content is being fetched for.
+func withPath(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, pathKey{}, path)
+}
+
+// pathFrom returns the path content is being fetched for, or "" if unknown.
+func pathFrom(ctx context.Context) string {
+	p, _ := ctx.Value(pathKey{}).(string)
+	return p
+}
+
+// pageContext returns the template data for sp.
+func (sp sitePage) pageContext() *PageContext {
+	pc := &PageContext{
+		Page:     sp.page,
+		Site:     siteInfo(sp.svr.site),
+		Path:     sp.path,
+		PrevPage: sp.prev,
+		NextPage: sp.next,
+		svr:      sp.svr,
+	}
+	if !sp.notFound {
+		pc.CanonicalURL = sp.svr.site.URLBase
+		if name := sp.page.Key.Name; name != "default" {
+			pc.CanonicalURL += name
+		}
+	}
+	return pc
+}
+
+// URL returns the URL path for a path on the site, such as "/index" or
+// "/highlight.css", including any path prefix (see PathPrefix). Templates
+// should use it for links to the site, e.g. {{.URL "/index"}} or
+// {{with .NextPage}}{{$.URL (print "/" .Key.Name)}}{{end}}.
+func (pc *PageContext) URL(path string) string {
+	return pc.svr.options.url(path)
+}
+
+// lookupContext returns a context for store lookups made while rendering.
+func lookupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+// RecentPosts returns up to n of the most recently created posts.
+func (pc *PageContext) RecentPosts(n int) ([]*Page, error) {
+	ctx, canc := lookupContext()
+	defer canc()
+	pages, err := pc.svr.store.QueryPages(ctx, pc.svr.site.Key, PageQuery{
+		BlogOnly: true,
+		Order:    "-Created",
+		Limit:    n,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching recent posts: %v", err)
+	}
+	return pages, nil
+}
+
+// TagCount is a tag, and the number of posts with that tag.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// SiteTags returns every tag used by posts on the site, with the number of
+// posts using each, sorted by tag.
+func (pc *PageContext) SiteTags() ([]TagCount, error) {
+	ctx, canc := lookupContext()
+	defer canc()
+	pages, err := pc.svr.store.QueryPages(ctx, pc.svr.site.Key, PageQuery{BlogOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("fetching all posts: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, p := range pages {
+		for _, t := range p.Tags {
+			if t != "" {
+				counts[t]++
+			}
+		}
+	}
+	tags := make([]TagCount, 0, len(counts))
+	for t, n := range counts {
+		tags = append(tags, TagCount{Tag: t, Count: n})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags, nil
+}
+
+// TOC returns the table of contents of the page: its headings (which are
+// given IDs when rendered) nested by level.
+func (pc *PageContext) TOC() ([]*TOCEntry, error) {
+	pc.tocOnce.Do(func() {
+		_, pc.toc, pc.tocErr = pc.svr.options.render(pc.svr.options.markdown, pc.Contents)
+	})
+	return pc.toc, pc.tocErr
+}
+
+// TOCHTML returns the table of contents of the page as nested lists, or
+// nothing if the page has no headings.
+func (pc *PageContext) TOCHTML() (template.HTML, error) {
+	toc, err := pc.TOC()
+	if err != nil {
+		return "", err
+	}
+	return tocHTML(toc), nil
+}
@@ -26,11 +26,12 @@ import (
 func (s *server) handlePreview(w http.ResponseWriter, r *http.Request) {
 	ctx, canc := context.WithTimeout(r.Context(), 10*time.Second)
 	defer canc()
+	ctx = withPath(ctx, r.URL.Path)
 
 	sp, err := s.fetchDraftPage(ctx, mux.Vars(r))
 	if err != nil {
 		log.Printf("handlePreview: not found: %v", err)
-		sp = &sitePage{site: s.site, page: notFoundPage}
+		sp = s.notFound
 	}
-	sp.Render(w, r)
+	sp.Render(w, r, -1)
 }
@@ -0,0 +1,256 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long to wait for Redis before giving up (and treating the request
+	// as a miss, or the write as not having happened).
+	redisTimeout = time.Second
+
+	// How long entries live in Redis. This is much longer than any sensible
+	// TTL, so that stale entries can still be served while being refreshed.
+	redisEntryLifetime = 24 * time.Hour
+)
+
+// redisCache is a cacheBackend shared between instances using Redis. Entries
+// are also kept in an in-process memCache, so most requests don't touch
+// Redis. Removals are broadcast to the other instances, which remove the
+// entries from their in-process caches.
+type redisCache struct {
+	client   redis.UniversalClient
+	prefix   string // of every key stored in Redis, for this site
+	channel  string // for broadcasting invalidations, for this site
+	origin   string // identifies this instance in broadcasts
+	local    *memCache
+	notFound content
+	pubsub   *redis.PubSub
+}
+
+// redisEntry is how a cacheEntry is stored in Redis.
+type redisEntry struct {
+	Fetched  time.Time
+	NotFound bool // the rest is empty; serve the 404 page
+
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+	Body        []byte
+	Gzip        []byte
+	Brotli      []byte
+}
+
+// invalidation is broadcast to every instance when entries are removed.
+type invalidation struct {
+	Origin string
+	Keys   []string `json:",omitempty"`
+	Prefix *string  `json:",omitempty"`
+}
+
+func newRedisCache(client redis.UniversalClient, siteKey string, local *memCache, notFound content) *redisCache {
+	b := make([]byte, 8)
+	rand.Read(b)
+	rc := &redisCache{
+		client:   client,
+		prefix:   "saebr:" + siteKey + ":",
+		channel:  "saebr:" + siteKey + ":invalidate",
+		origin:   hex.EncodeToString(b),
+		local:    local,
+		notFound: notFound,
+	}
+	rc.pubsub = client.Subscribe(context.Background(), rc.channel)
+	go rc.listen()
+	return rc
+}
+
+// listen applies invalidations broadcast by other instances, until the
+// subscription is closed.
+func (rc *redisCache) listen() {
+	for msg := range rc.pubsub.Channel() {
+		var inv invalidation
+		if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+			log.Printf("Couldn't unmarshal cache invalidation: %v", err)
+			continue
+		}
+		if inv.Origin == rc.origin {
+			continue
+		}
+		rc.local.remove(inv.Keys...)
+		if inv.Prefix != nil {
+			rc.local.removePrefix(*inv.Prefix)
+		}
+	}
+}
+
+func (rc *redisCache) get(key string) (cacheEntry, bool) {
+	if ent, ok := rc.local.get(key); ok {
+		return ent, true
+	}
+
+	ctx, canc := context.WithTimeout(context.Background(), redisTimeout)
+	defer canc()
+	v, err := rc.client.Get(ctx, rc.prefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Couldn't get %q from Redis: %v", key, err)
+		}
+		return cacheEntry{}, false
+	}
+	var re redisEntry
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&re); err != nil {
+		log.Printf("Couldn't decode %q from Redis: %v", key, err)
+		return cacheEntry{}, false
+	}
+	ent := cacheEntry{
+		fetched:  re.Fetched,
+		notFound: re.NotFound,
+		content:  rc.notFound,
+	}
+	if !re.NotFound {
+		ent.content = &rendered{
+			contentType: re.ContentType,
+			modTime:     re.ModTime,
+			etag:        re.ETag,
+			body:        re.Body,
+			gzip:        re.Gzip,
+			brotli:      re.Brotli,
+		}
+	}
+	rc.local.put(key, ent)
+	return ent, true
+}
+
+func (rc *redisCache) put(key string, ent cacheEntry) {
+	rc.local.put(key, ent)
+
+	re := redisEntry{
+		Fetched:  ent.fetched,
+		NotFound: ent.notFound,
+	}
+	if !ent.notFound {
+		rd := ent.content.output()
+		if rd == nil {
+			// Rendering failed; don't share the failure.
+			return
+		}
+		re.ContentType = rd.contentType
+		re.ModTime = rd.modTime
+		re.ETag = rd.etag
+		re.Body, re.Gzip, re.Brotli = rd.body, rd.gzip, rd.brotli
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&re); err != nil {
+		log.Printf("Couldn't encode %q for Redis: %v", key, err)
+		return
+	}
+
+	ctx, canc := context.WithTimeout(context.Background(), redisTimeout)
+	defer canc()
+	if err := rc.client.Set(ctx, rc.prefix+key, buf.Bytes(), redisEntryLifetime).Err(); err != nil {
+		log.Printf("Couldn't put %q in Redis: %v", key, err)
+	}
+}
+
+// publish broadcasts an invalidation to the other instances.
+func (rc *redisCache) publish(ctx context.Context, inv invalidation) {
+	inv.Origin = rc.origin
+	msg, err := json.Marshal(inv)
+	if err != nil {
+		log.Printf("Couldn't marshal cache invalidation: %v", err)
+		return
+	}
+	if err := rc.client.Publish(ctx, rc.channel, msg).Err(); err != nil {
+		log.Printf("Couldn't publish cache invalidation: %v", err)
+	}
+}
+
+func (rc *redisCache) remove(keys ...string) int {
+	n := rc.local.remove(keys...)
+
+	ctx, canc := context.WithTimeout(context.Background(), redisTimeout)
+	defer canc()
+	rkeys := make([]string, len(keys))
+	for i, key := range keys {
+		rkeys[i] = rc.prefix + key
+	}
+	if len(rkeys) > 0 {
+		if err := rc.client.Del(ctx, rkeys...).Err(); err != nil {
+			log.Printf("Couldn't delete keys from Redis: %v", err)
+		}
+	}
+	rc.publish(ctx, invalidation{Keys: keys})
+	return n
+}
+
+func (rc *redisCache) removePrefix(prefix string) int {
+	n := rc.local.removePrefix(prefix)
+
+	ctx, canc := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer canc()
+	if err := rc.deletePrefix(ctx, prefix); err != nil {
+		log.Printf("Couldn't delete keys with prefix %q from Redis: %v", prefix, err)
+	}
+	rc.publish(ctx, invalidation{Prefix: &prefix})
+	return n
+}
+
+// deletePrefix deletes all the keys of the site starting with prefix from
+// Redis.
+func (rc *redisCache) deletePrefix(ctx context.Context, prefix string) error {
+	iter := rc.client.Scan(ctx, 0, globEscape(rc.prefix+prefix)+"*", 100).Iterator()
+	var errs []error
+	for iter.Next(ctx) {
+		if err := rc.client.Del(ctx, iter.Val()).Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(append(errs, iter.Err())...)
+}
+
+// globEscape escapes the characters special to Redis glob-style patterns.
+func globEscape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\^`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (rc *redisCache) stats(st *CacheStats) { rc.local.stats(st) }
+
+func (rc *redisCache) keys(limit int) []cacheKeyInfo { return rc.local.keys(limit) }
+
+func (rc *redisCache) close() {
+	if err := rc.pubsub.Close(); err != nil {
+		log.Printf("Couldn't close Redis subscription: %v", err)
+	}
+}
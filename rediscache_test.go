@@ -0,0 +1,150 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisCaches returns two redisCaches for the same site, as if in two
+// instances, sharing an in-process Redis stand-in.
+func newTestRedisCaches(t *testing.T) (mr *miniredis.Miniredis, a, b *redisCache) {
+	t.Helper()
+	mr = miniredis.RunT(t)
+	o := newOptions(nil)
+	notFound := newRendered("text/plain", time.Time{}, []byte("not found"))
+	newInstance := func() *redisCache {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		rc := newRedisCache(client, "test", newMemCache(o), notFound)
+		t.Cleanup(func() {
+			rc.close()
+			client.Close()
+		})
+		return rc
+	}
+	a, b = newInstance(), newInstance()
+
+	// Subscribing happens in the background; wait for it, so that no
+	// invalidations are missed.
+	deadline := time.Now().Add(5 * time.Second)
+	for mr.PubSubNumSub(a.channel)[a.channel] < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("redisCaches didn't subscribe to invalidations")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return mr, a, b
+}
+
+// eventually polls cond until it is true, or fails the test after a while.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisCacheRoundTrip(t *testing.T) {
+	_, a, b := newTestRedisCaches(t)
+	fetched := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := newRendered("text/html; charset=utf-8", fetched.Add(-time.Hour), []byte(strings.Repeat("<p>Hello, world.</p>\n", 100)))
+	if want.gzip == nil || want.brotli == nil {
+		t.Fatal("newRendered didn't compress the test body; make it bigger")
+	}
+	a.put("/hello", cacheEntry{fetched: fetched, content: want})
+	a.put("/missing", cacheEntry{fetched: fetched, content: a.notFound, notFound: true})
+
+	// b has nothing locally, so gets the entries from Redis.
+	ent, ok := b.get("/hello")
+	if !ok {
+		t.Fatal("b.get(/hello) missed, want a hit from Redis")
+	}
+	if !ent.fetched.Equal(fetched) || ent.notFound {
+		t.Errorf("b.get(/hello) fetched, notFound = %v, %t; want %v, false", ent.fetched, ent.notFound, fetched)
+	}
+	got, _ := ent.content.(*rendered)
+	switch {
+	case got == nil:
+		t.Fatalf("b.get(/hello) content = %T, want *rendered", ent.content)
+	case got.contentType != want.contentType:
+		t.Errorf("contentType = %q, want %q", got.contentType, want.contentType)
+	case !got.modTime.Equal(want.modTime):
+		t.Errorf("modTime = %v, want %v", got.modTime, want.modTime)
+	case got.etag != want.etag:
+		t.Errorf("etag = %q, want %q", got.etag, want.etag)
+	case !bytes.Equal(got.body, want.body):
+		t.Errorf("body = %q, want %q", got.body, want.body)
+	case !bytes.Equal(got.gzip, want.gzip):
+		t.Error("gzip variant differs")
+	case !bytes.Equal(got.brotli, want.brotli):
+		t.Error("brotli variant differs")
+	}
+
+	ent, ok = b.get("/missing")
+	if !ok || !ent.notFound || ent.content != b.notFound {
+		t.Errorf("b.get(/missing) = %+v, %t; want a hit for the not found page", ent, ok)
+	}
+
+	// Now b has them locally.
+	if _, ok := b.local.get("/hello"); !ok {
+		t.Error("b.local.get(/hello) missed after b.get(/hello)")
+	}
+}
+
+func TestRedisCacheRemove(t *testing.T) {
+	mr, a, b := newTestRedisCaches(t)
+	for _, key := range []string{"/a", "/tags/x", "/tags/y", "/b"} {
+		a.put(key, cacheEntry{fetched: time.Now(), content: newRendered("text/plain", time.Time{}, []byte(key))})
+		if _, ok := b.get(key); !ok {
+			t.Fatalf("b.get(%s) missed", key)
+		}
+	}
+
+	if n := a.remove("/a"); n != 1 {
+		t.Errorf("a.remove(/a) = %d, want 1", n)
+	}
+	if mr.Exists("saebr:test:/a") {
+		t.Error("/a is still in Redis after remove")
+	}
+	eventually(t, "b removes /a from its local cache", func() bool {
+		_, ok := b.local.get("/a")
+		return !ok
+	})
+
+	if n := a.removePrefix("/tags/"); n != 2 {
+		t.Errorf("a.removePrefix(/tags/) = %d, want 2", n)
+	}
+	if got, want := mr.Keys(), []string{"saebr:test:/b"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("keys in Redis after removePrefix = %v, want %v", got, want)
+	}
+	eventually(t, "b removes /tags/ from its local cache", func() bool {
+		_, okx := b.local.get("/tags/x")
+		_, oky := b.local.get("/tags/y")
+		return !okx && !oky
+	})
+	if _, ok := b.local.get("/b"); !ok {
+		t.Error("b.local.get(/b) missed, want it kept")
+	}
+}
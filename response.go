@@ -0,0 +1,146 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Responses smaller than this aren't worth compressing.
+const minCompressSize = 512
+
+// rendered is content rendered to bytes, together with compressed variants,
+// ready to serve many times over.
+type rendered struct {
+	contentType string
+	modTime     time.Time
+	notFound    bool   // serve with status 404
+	etag        string // hash of body, without quotes
+
+	body   []byte
+	gzip   []byte // nil if not worth it
+	brotli []byte // nil if not worth it
+}
+
+// newRendered compresses the body, and returns it as a rendered.
+func newRendered(contentType string, modTime time.Time, body []byte) *rendered {
+	sum := sha256.Sum256(body)
+	rd := &rendered{
+		contentType: contentType,
+		modTime:     modTime,
+		etag:        base64.RawURLEncoding.EncodeToString(sum[:18]),
+		body:        body,
+	}
+	if len(body) < minCompressSize {
+		return rd
+	}
+
+	gz := new(bytes.Buffer)
+	gw, _ := gzip.NewWriterLevel(gz, gzip.BestCompression)
+	gw.Write(body)
+	gw.Close()
+	if gz.Len() < len(body) {
+		rd.gzip = gz.Bytes()
+	}
+
+	br := new(bytes.Buffer)
+	bw := brotli.NewWriterLevel(br, brotli.DefaultCompression)
+	bw.Write(body)
+	bw.Close()
+	if br.Len() < len(body) {
+		rd.brotli = br.Bytes()
+	}
+	return rd
+}
+
+// Size returns the total size of the body and its variants.
+func (rd *rendered) Size() int {
+	return len(rd.body) + len(rd.gzip) + len(rd.brotli)
+}
+
+// output returns rd, so that a rendered is itself content.
+func (rd *rendered) output() *rendered { return rd }
+
+// Render serves the content.
+func (rd *rendered) Render(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+	rd.serve(w, r, maxAge)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows the
+// given encoding.
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		if name != enc && name != "*" {
+			continue
+		}
+		params = strings.TrimSpace(params)
+		if q, ok := strings.CutPrefix(params, "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serve writes the response, choosing the best encoding the client accepts.
+// Conditional (If-None-Match, If-Modified-Since) and range requests are
+// handled by http.ServeContent.
+//
+// The ETag is a hash of the uncompressed content (with a suffix for each
+// compressed variant, since they are different representations). Since it
+// depends only on the content, every instance serving the same content agrees
+// on it, and any change to the output (whether from the page, a neighbour,
+// or the template) changes it.
+func (rd *rendered) serve(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+	h := w.Header()
+	setCacheHeaders(h, maxAge)
+	h.Set("Content-Type", rd.contentType)
+
+	body, etag := rd.body, rd.etag
+	if rd.gzip != nil || rd.brotli != nil {
+		h.Add("Vary", "Accept-Encoding")
+		ae := r.Header.Get("Accept-Encoding")
+		switch {
+		case rd.brotli != nil && acceptsEncoding(ae, "br"):
+			h.Set("Content-Encoding", "br")
+			body, etag = rd.brotli, etag+"-br"
+		case rd.gzip != nil && acceptsEncoding(ae, "gzip"):
+			h.Set("Content-Encoding", "gzip")
+			body, etag = rd.gzip, etag+"-gz"
+		}
+	}
+	h.Set("ETag", `"`+etag+`"`)
+
+	if rd.notFound {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(body)
+		return
+	}
+	http.ServeContent(w, r, "", rd.modTime, bytes.NewReader(body))
+}
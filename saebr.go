@@ -17,24 +17,23 @@ package saebr // import "drjosh.dev/saebr"
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
+	"expvar"
+	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
-	"github.com/russross/blackfriday/v2"
+	"github.com/redis/go-redis/v9"
 )
 
-const cacheTTL = time.Minute
-
 func maxTime(a, b time.Time) time.Time {
 	if a.After(b) {
 		return a
@@ -43,16 +42,48 @@ func maxTime(a, b time.Time) time.Time {
 }
 
 type server struct {
-	client  *datastore.Client
-	site    *Site
-	options *options
+	store    Store
+	site     *Site
+	options  *options
+	cache    *cache
+	notFound sitePage
+
+	tmplWatcher *fsnotify.Watcher // nil if not watching
+	stopNotify  func()            // nil if the store doesn't notify changes
+	reloadSite  func()            // reloads the site after it changes in the store
 }
 
 type options struct {
-	cacheMaxSize  int
-	dsProjectID   string
-	rootAction    ServeAction
-	templateFuncs template.FuncMap
+	boltPath          string
+	cacheDisabled     bool
+	cacheMaxBytes     int
+	cacheMaxNotFound  int
+	cacheMaxSize      int
+	cacheTTLs         map[CacheRoute]time.Duration
+	contentDir        string
+	dsProjectID       string
+	hostSites         map[string]string
+	idleTimeout       time.Duration
+	listenAddr        string
+	markdown          MarkdownRenderer
+	pathPrefix        string
+	mathDisabled      bool
+	feedMarkdown      MarkdownRenderer
+	highlightStyle    string
+	tocMarker         string
+	redisClient       redis.UniversalClient
+	readTimeout       time.Duration
+	rootAction        ServeAction
+	seedSites         map[string]siteSeed
+	shortcodes        map[string]Shortcode
+	unknownShortcodes sync.Map // names already logged as unknown
+	shutdownTimeout   time.Duration
+	store             Store
+	templateFuncs     template.FuncMap
+	tlsCertFile       string
+	tlsKeyFile        string
+	unixSocket        string
+	writeTimeout      time.Duration
 }
 
 // ServeAction describes some possible actions for handling a request.
@@ -65,17 +96,100 @@ const (
 	ServeDefault                        // Serve a normal page (key "default")
 )
 
-// Option is the type of each functional option to Run.
+// Option is the type of each functional option to New or Run.
 type Option func(*options)
 
-// TODO: provide an option for disabling the cache.
+// CacheRoute identifies a group of routes with the same cache policy.
+type CacheRoute int
+
+// Values for CacheRoute.
+const (
+	PageRoutes   CacheRoute = iota // Pages and posts, including the root
+	FeedRoutes                     // RSS, Atom, and JSON feeds
+	IndexRoute                     // The index of all posts
+	SitemapRoute                   // sitemap.xml
+)
+
+// CacheTTL sets how long content for a group of routes is cached, both in
+// saebr's page cache and (via Cache-Control and Expires headers) by browsers
+// and CDNs. The default for each is one minute. A TTL of zero disables caching
+// for the routes.
+func CacheTTL(route CacheRoute, ttl time.Duration) Option {
+	return func(o *options) { o.cacheTTLs[route] = ttl }
+}
+
+// DisableCache disables the page cache, so every request fetches content
+// from the store. Responses are sent with "Cache-Control: no-cache".
+func DisableCache() Option {
+	return func(o *options) { o.cacheDisabled = true }
+}
 
-// CacheMaxSize configures the maximum size for the page cache. The default is
-// 10000.
+// CacheMaxSize configures the maximum number of entries in the page cache.
+// The default is 10000. When the cache is full, the least recently used
+// entries are evicted.
 func CacheMaxSize(n int) Option {
 	return func(o *options) { o.cacheMaxSize = n }
 }
 
+// CacheMaxBytes configures the maximum total size of rendered content in the
+// page cache. The default is 64 MiB. 0 means no limit.
+func CacheMaxBytes(n int) Option {
+	return func(o *options) { o.cacheMaxBytes = n }
+}
+
+// CacheMaxNotFound configures the maximum number of "not found" entries in the
+// page cache. These are kept separately from the other entries, so that
+// requests for nonexistent URLs can't push out real content. The default is
+// 1000.
+func CacheMaxNotFound(n int) Option {
+	return func(o *options) { o.cacheMaxNotFound = n }
+}
+
+// Markdown sets the renderer used to convert Markdown to HTML, in templates
+// (with the "markdown" function, or "blackfridayRun" for older templates),
+// feeds, and the index. The default is BlackfridayRenderer().
+func Markdown(r MarkdownRenderer) Option {
+	return func(o *options) { o.markdown = r }
+}
+
+// SyntaxHighlighting enables server-side highlighting of fenced code blocks
+// by the built-in Markdown renderers, using the named chroma style (such as
+// "github" or "monokai"). In pages, code is marked up with CSS classes, and
+// the stylesheet for the style is served at /highlight.css (which the page
+// template should link to, with {{.URL "/highlight.css"}}). Feeds use inline styles instead, since feed
+// readers don't fetch stylesheets.
+//
+// New reports an error if the Markdown renderer can't highlight code: if it
+// isn't one of the built-in renderers, or is given its own HTML renderer
+// (such as with blackfriday.WithRenderer).
+func SyntaxHighlighting(style string) Option {
+	return func(o *options) { o.highlightStyle = style }
+}
+
+// TOCMarker sets a marker which, when it appears as a paragraph on its own in
+// Markdown content, is replaced with the table of contents of the content
+// (for example "[TOC]"). By default there is no marker; templates can still
+// use the TOC and TOCHTML methods of PageContext.
+func TOCMarker(marker string) Option {
+	return func(o *options) { o.tocMarker = marker }
+}
+
+// DisableMath turns off rendering of TeX math in page contents. By default,
+// $inline$ and $$display$$ math is converted to MathML on the server, so it
+// displays without JavaScript, including in feeds.
+func DisableMath() Option {
+	return func(o *options) { o.mathDisabled = true }
+}
+
+// RedisCache shares the page cache between instances of the server (such as
+// several App Engine instances) using Redis, or anything else speaking the
+// Redis protocol. Each instance keeps its in-process cache in front of Redis,
+// and invalidations (from edits or the cache admin page) are broadcast to
+// every instance over Redis pub/sub.
+func RedisCache(client redis.UniversalClient) Option {
+	return func(o *options) { o.redisClient = client }
+}
+
 // DatastoreProjectID sets the project ID used for the Cloud Datastore client.
 // The default is the empty string (the client then obtains the project ID from
 // the DATASTORE_PROJECT_ID env var).
@@ -83,6 +197,62 @@ func DatastoreProjectID(projID string) Option {
 	return func(o *options) { o.dsProjectID = projID }
 }
 
+// BoltDBPath configures saebr to store everything in a local bbolt database
+// file at the given path, instead of Cloud Datastore. The file is created if
+// it doesn't exist. To give the site in a new file real values instead of
+// placeholders, use SeedSite.
+func BoltDBPath(path string) Option {
+	return func(o *options) { o.boltPath = path }
+}
+
+// ContentDir configures saebr to serve pages read-only from a directory of
+// Markdown files with YAML or TOML front matter (see OpenDirStore), for
+// example a git checkout. Changes to the directory, including the site file,
+// are picked up automatically. Editing through /edit is not possible.
+func ContentDir(dir string) Option {
+	return func(o *options) { o.contentDir = dir }
+}
+
+// UseStore sets the Store used for Site and Page entities. The default is to
+// use Cloud Datastore (see DatastoreProjectID).
+func UseStore(st Store) Option {
+	return func(o *options) { o.store = st }
+}
+
+// InMemoryStore configures saebr to store everything in memory, which is
+// handy for local development and tests. Everything is lost when the program
+// exits. To start with some content, use SeedSite. To inspect the store, use
+// UseStore(NewMemStore()) instead.
+func InMemoryStore() Option {
+	return UseStore(NewMemStore())
+}
+
+// SeedSite provides the Site to create, together with some pages, if the site
+// with the key site.Key doesn't exist in the store when it is loaded. Without
+// it, a Site with placeholder values (and no pages) is created. A random
+// Secret is generated if site has none. Page keys are names, and their
+// parents are set to site.Key. Can be passed multiple times, for different
+// sites.
+func SeedSite(site *Site, pages ...*Page) Option {
+	return func(o *options) { o.seedSites[site.Key.Name] = siteSeed{site: site, pages: pages} }
+}
+
+// HostSite serves the site with the given key for requests with the given
+// Host header (ignoring any port). Can be passed multiple times.
+func HostSite(host, siteKey string) Option {
+	return func(o *options) { o.hostSites[hostname(host)] = siteKey }
+}
+
+// PathPrefix serves the sites under a path prefix (such as "/blog"), for
+// mounting the Server alongside other handlers. Requests are expected to
+// include the prefix, which is removed before routing, and URLs generated by
+// saebr (such as redirects and links in the index) include it. Page templates
+// can include it with PageContext.URL. Requests without the prefix are not
+// found.
+func PathPrefix(prefix string) Option {
+	return func(o *options) { o.pathPrefix = strings.TrimSuffix(prefix, "/") }
+}
+
 // RootServeAction changes how the root of the site is handled.
 func RootServeAction(sa ServeAction) Option {
 	return func(o *options) { o.rootAction = sa }
@@ -98,122 +268,173 @@ func TemplateFuncs(fm template.FuncMap) Option {
 	}
 }
 
-// Template funcs
-
-func blackfridayRun(s string) template.HTML {
-	return template.HTML(blackfriday.Run([]byte(s)))
-}
-
-func materializeULTags(s template.HTML) template.HTML {
-	return template.HTML(strings.Replace(string(s), "<ul>", `<ul class="browser-default">`, -1))
+// Shortcodes allows providing custom shortcodes for use in page contents,
+// in addition to the built-in figure, youtube, callout, and gist shortcodes
+// (which can be overridden). Can be passed multiple times.
+func Shortcodes(sc map[string]Shortcode) Option {
+	return func(o *options) {
+		for k, f := range sc {
+			o.shortcodes[k] = f
+		}
+	}
 }
 
-// Run runs saebr.
-//
-// saebr makes the following assumptions:
-//
-//   - It's running on Google App Engine, so runs as an unencrypted HTTP
-//     server. (App Engine can provide HTTPS and HTTP/2.)
-//   - Run can exit the program (using log.Fatal) if an error occurs.
-//   - Serving port is given by the PORT env var, or if empty assumes 8080.
-func Run(siteKey string, opts ...Option) {
-	ctx := context.Background()
-
+func newOptions(opts []Option) *options {
 	o := &options{
-		cacheMaxSize: 10000,
-		templateFuncs: template.FuncMap{
-			// Built-in template functions - can be overridden
-			"blackfridayRun":    blackfridayRun,
-			"materialiseULTags": materializeULTags,
+		cacheMaxBytes:    64 << 20,
+		cacheMaxNotFound: 1000,
+		cacheMaxSize:     10000,
+		cacheTTLs: map[CacheRoute]time.Duration{
+			PageRoutes:   time.Minute,
+			FeedRoutes:   time.Minute,
+			IndexRoute:   time.Minute,
+			SitemapRoute: time.Minute,
 		},
+		readTimeout:     30 * time.Second,
+		writeTimeout:    60 * time.Second,
+		idleTimeout:     120 * time.Second,
+		shutdownTimeout: 10 * time.Second,
+		hostSites:       make(map[string]string),
+		markdown:        BlackfridayRenderer(),
+	}
+	o.templateFuncs = template.FuncMap{
+		// Built-in template functions - can be overridden
+		"markdown":          o.renderMarkdown,
+		"blackfridayRun":    o.renderMarkdown, // uses the configured renderer, despite the name
+		"materialiseULTags": materializeULTags,
+	}
+	o.seedSites = make(map[string]siteSeed)
+	o.shortcodes = make(map[string]Shortcode, len(builtinShortcodes))
+	for k, f := range builtinShortcodes {
+		o.shortcodes[k] = f
 	}
 	for _, opt := range opts {
 		opt(o)
 	}
+	o.feedMarkdown = o.markdown
+	return o
+}
 
-	dscli, err := datastore.NewClient(ctx, o.dsProjectID)
-	if err != nil {
-		log.Fatalf("Couldn't create datastore client: %v", err)
+// cacheTTL returns the TTL for a group of routes, taking DisableCache into
+// account.
+func (o *options) cacheTTL(route CacheRoute) time.Duration {
+	if o.cacheDisabled {
+		return 0
 	}
-	site := &Site{Key: datastore.NameKey("Site", siteKey, nil)}
-	if err := dscli.Get(ctx, site.Key, site); err != nil {
-		if err != datastore.ErrNoSuchEntity {
-			log.Fatalf("Couldn't fetch site object: %v", err)
+	return o.cacheTTLs[route]
+}
+
+// Template funcs
+
+func materializeULTags(s template.HTML) template.HTML {
+	return template.HTML(strings.Replace(string(s), "<ul>", `<ul class="browser-default">`, -1))
+}
+
+// openStore opens the Store configured by the options.
+func openStore(ctx context.Context, o *options) (Store, error) {
+	switch {
+	case o.store != nil:
+		return o.store, nil
+	case o.contentDir != "":
+		st, err := OpenDirStore(o.contentDir)
+		if err != nil {
+			return nil, fmt.Errorf("open content directory: %v", err)
 		}
-		// Fill in some sensible defaults and create it
-		secret := make([]byte, 32)
-		if _, err := rand.Read(secret); err != nil {
-			log.Fatalf("Couldn't generate a secret: %v", err)
+		return st, nil
+	case o.boltPath != "":
+		st, err := OpenBoltStore(o.boltPath)
+		if err != nil {
+			return nil, fmt.Errorf("open bolt store: %v", err)
 		}
-		site.Secret = base64.StdEncoding.EncodeToString(secret)
-		site.AdminEmail = "your.google.account.email.address@example.com"
-		site.FeedAuthor = "Your Name"
-		site.FeedCopyright = "Copyright © Your Name"
-		site.FeedDescription = "Description for feeds"
-		site.FeedSubtitle = "Subtitle for feeds"
-		site.FeedTitle = "Title for feeds"
-		site.PageTemplate = "your_page_template.html"
-		site.TimeLocation = time.Local.String()
-		site.URLBase = "https://your.site.example.com/"
-		site.WebSignInClientID = "a web sign-in client ID - typically a number, then some base64 encoded data, followed by .apps.googleusercontent.com"
-		if _, err := dscli.Put(ctx, site.Key, site); err != nil {
-			log.Fatalf("Couldn't create a new Site entity: %v", err)
+		return st, nil
+	default:
+		st, err := newDatastoreStore(ctx, o.dsProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("create datastore client: %v", err)
 		}
+		return st, nil
 	}
-	if len(site.Secret) < 16 {
-		log.Fatal("Insufficient secret (len < 16)")
-	}
-	loc, err := time.LoadLocation(site.TimeLocation)
+}
+
+// newServer loads the site with the given key and sets up a server for it.
+// reload is called if the store reports that the site has changed.
+func newServer(ctx context.Context, store Store, siteKey string, o *options, reload func()) (*server, error) {
+	site, err := loadSite(ctx, store, siteKey, o)
 	if err != nil {
-		log.Fatalf("Couldn't load time location: %v", err)
+		return nil, err
 	}
-	site.timeLoc = loc
-	fi, err := os.Stat(site.PageTemplate)
-	if err != nil {
-		log.Fatalf("Couldn't find page template: %v", err)
-	}
-	site.pageTmplMtime = fi.ModTime()
-	site.cookieStore = sessions.NewCookieStore([]byte(site.Secret))
-	site.pageTmpl = template.Must(
-		template.New(path.Base(site.PageTemplate)).
-			Funcs(o.templateFuncs).
-			ParseFiles(site.PageTemplate),
-	)
 	svr := &server{
-		client:  dscli,
-		site:    site,
-		options: o,
+		store:      store,
+		site:       site,
+		options:    o,
+		reloadSite: reload,
 	}
-	cache := &cache{
-		limit: o.cacheMaxSize,
-		cache: make(map[string]cacheEntry),
-		notFound: sitePage{
-			site: site,
-			page: notFoundPage,
-		},
+	svr.notFound = sitePage{
+		svr:      svr,
+		page:     newNotFoundPage(),
+		notFound: true,
+	}
+	svr.cache = newCache(o, siteKey, svr.notFound)
+	if err := svr.watchTemplate(); err != nil {
+		// Not fatal; the template just won't be reloaded.
+		log.Printf("Couldn't watch page template: %v", err)
+	}
+	if cn, ok := store.(changeNotifier); ok {
+		svr.stopNotify = cn.notifyChanges(svr.storeChanged)
+	}
+	cacheVars.Set(siteKey, expvar.Func(func() any { return svr.cache.stats() }))
+	return svr, nil
+}
+
+// storeChanged handles changes made to the store outside of saebr: pages that
+// changed are purged from the cache, and if the site changed, it is reloaded
+// (with a fresh cache).
+func (svr *server) storeChanged(c storeChange) {
+	if c.site {
+		svr.reloadSite()
+		return
+	}
+	keys := make([]*datastore.Key, 0, len(c.pages))
+	for _, name := range c.pages {
+		keys = append(keys, datastore.NameKey("Page", name, svr.site.Key))
 	}
+	svr.invalidate(keys...)
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-		log.Printf("Defaulting to port %s", port)
+// close stops watching the template and the store, and releases the cache.
+func (svr *server) close() {
+	if svr.tmplWatcher != nil {
+		svr.tmplWatcher.Close()
+	}
+	if svr.stopNotify != nil {
+		svr.stopNotify()
 	}
+	svr.cache.close()
+}
 
+// router returns a handler for all the routes of the site.
+func (svr *server) router() http.Handler {
+	o, cache := svr.options, svr.cache
+	pageTTL := o.cacheTTL(PageRoutes)
+	feedTTL := o.cacheTTL(FeedRoutes)
 	r := mux.NewRouter()
 
 	// How to fetch a feed (as seen in <meta>)
-	r.Handle("/rss.xml", cache.server(svr.fetchRSS, ""))
-	r.Handle("/atom.xml", cache.server(svr.fetchAtom, ""))
-	r.Handle("/feed.json", cache.server(svr.fetchJSONFeed, ""))
+	r.Handle("/rss.xml", cache.server(svr.fetchRSS, "", feedTTL))
+	r.Handle("/atom.xml", cache.server(svr.fetchAtom, "", feedTTL))
+	r.Handle("/feed.json", cache.server(svr.fetchJSONFeed, "", feedTTL))
 
 	// How to fetch a feed 2 - Wordpress Boogaloo
-	r.Handle("/feed", cache.server(svr.fetchRSS, "/rss.xml"))
-	r.Handle("/feed/", cache.server(svr.fetchRSS, "/rss.xml"))
+	r.Handle("/feed", cache.server(svr.fetchRSS, "/rss.xml", feedTTL))
+	r.Handle("/feed/", cache.server(svr.fetchRSS, "/rss.xml", feedTTL))
 
 	// Other easy routes
-	r.Handle("/sitemap.xml", cache.server(svr.fetchSitemap, ""))
-	r.Handle("/index", cache.server(svr.fetchIndex, ""))
+	r.Handle("/sitemap.xml", cache.server(svr.fetchSitemap, "", o.cacheTTL(SitemapRoute)))
+	r.Handle("/index", cache.server(svr.fetchIndex, "", o.cacheTTL(IndexRoute)))
 	r.HandleFunc("/login", svr.handleLogin)
+	if o.highlightStyle != "" {
+		r.Handle(highlightCSSPath, highlightCSS(o.highlightStyle, pageTTL))
+	}
 
 	// Editing
 	s := r.PathPrefix("/edit").Subrouter()
@@ -223,6 +444,13 @@ func Run(siteKey string, opts ...Option) {
 	s.HandleFunc("", svr.handleEditGet).Methods(http.MethodGet)
 	s.HandleFunc("", svr.handleEditPost).Methods(http.MethodPost)
 
+	// Administration
+	a := r.PathPrefix("/admin").Subrouter()
+	a.Use(svr.authMiddleware)
+	a.HandleFunc("/cache", svr.handleCacheAdminGet).Methods(http.MethodGet)
+	a.HandleFunc("/cache", svr.handleCacheAdminPost).Methods(http.MethodPost)
+	a.HandleFunc("/template", svr.handleTemplateAdmin).Methods(http.MethodGet)
+
 	// Previewing
 	p := r.PathPrefix("/preview").Subrouter()
 	p.Use(svr.authMiddleware)
@@ -230,26 +458,214 @@ func Run(siteKey string, opts ...Option) {
 
 	// Pages and posts
 	r.HandleFunc("/latest", svr.redirectToLatest)
-	r.Handle("/{page}", cache.server(svr.fetchPage, ""))
+	r.Handle("/{page}", cache.server(svr.fetchPage, "", pageTTL))
 
 	// How to fetch a feed 3 - revenge of the query parameters
 	q := r.Path("/").Subrouter()
-	q.Handle("/", cache.server(svr.fetchRSS, "/rss.xml")).Queries("feed", "rss")
-	q.Handle("/", cache.server(svr.fetchAtom, "/atom.xml")).Queries("feed", "atom")
+	q.Handle("/", cache.server(svr.fetchRSS, "/rss.xml", feedTTL)).Queries("feed", "rss")
+	q.Handle("/", cache.server(svr.fetchAtom, "/atom.xml", feedTTL)).Queries("feed", "atom")
 
 	switch o.rootAction {
 	case RedirectToLatest:
 		q.HandleFunc("/", svr.redirectToLatest)
 
 	case ServeLatest:
-		q.Handle("/", cache.server(svr.fetchLatest, ""))
+		q.Handle("/", cache.server(svr.fetchLatest, "", pageTTL))
 
 	case ServeDefault:
-		q.Handle("/", cache.server(svr.fetchFixed("default"), "/default"))
+		q.Handle("/", cache.server(svr.fetchFixed("default"), "/default", pageTTL))
+	}
+
+	if o.pathPrefix == "" {
+		return r
+	}
+	stripped := http.StripPrefix(o.pathPrefix, r)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == o.pathPrefix {
+			http.Redirect(w, req, o.pathPrefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		stripped.ServeHTTP(w, req)
+	})
+}
+
+// url returns the URL path for a path within the site, including the path
+// prefix (see PathPrefix).
+func (o *options) url(path string) string {
+	return o.pathPrefix + path
+}
+
+// Server serves one or more saebr sites. It implements http.Handler.
+type Server struct {
+	store   Store
+	options *options
+	defKey  string // key of the default site
+
+	mu    sync.Mutex
+	sites map[string]*siteEntry // by site key
+}
+
+// siteEntry holds a site that is loaded, or being loaded.
+type siteEntry struct {
+	ready   chan struct{} // closed once svr, handler, and err are set
+	svr     *server
+	handler http.Handler
+	err     error
+}
+
+// New creates a new saebr Server for the site with the given key. Unlike Run,
+// it doesn't listen for connections, and reports errors instead of exiting.
+// If the site doesn't exist in the store, it is created from SeedSite if
+// given, or with placeholder values otherwise.
+//
+// Other sites can be served from the same Server by mapping hosts to them with
+// HostSite. They are loaded when first requested. Requests for any other host
+// are served by the site with the given key.
+func New(ctx context.Context, siteKey string, opts ...Option) (*Server, error) {
+	o := newOptions(opts)
+	if err := o.setupHighlighting(); err != nil {
+		return nil, err
+	}
+	store, err := openStore(ctx, o)
+	if err != nil {
+		return nil, err
 	}
+	s := &Server{
+		store:   store,
+		options: o,
+		defKey:  siteKey,
+		sites:   make(map[string]*siteEntry),
+	}
+	// Load the default site now, to report any problems with it.
+	if _, err := s.site(ctx, siteKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// site returns the entry for the site with the given key, loading it first if
+// needed. Sites that fail to load are retried on the next call.
+func (s *Server) site(ctx context.Context, siteKey string) (*siteEntry, error) {
+	s.mu.Lock()
+	ent := s.sites[siteKey]
+	if ent != nil {
+		s.mu.Unlock()
+		<-ent.ready
+		return ent, ent.err
+	}
+	ent = &siteEntry{ready: make(chan struct{})}
+	s.sites[siteKey] = ent
+	s.mu.Unlock()
+
+	s.load(ctx, siteKey, ent)
+	if ent.err != nil {
+		s.mu.Lock()
+		if s.sites[siteKey] == ent {
+			delete(s.sites, siteKey)
+		}
+		s.mu.Unlock()
+	}
+	return ent, ent.err
+}
+
+// load loads a site into ent, and marks it ready.
+func (s *Server) load(ctx context.Context, siteKey string, ent *siteEntry) {
+	defer close(ent.ready)
+	svr, err := newServer(ctx, s.store, siteKey, s.options, func() {
+		s.mu.Lock()
+		current := s.sites[siteKey] == ent
+		s.mu.Unlock()
+		if !current {
+			// Already reloaded, or the Server is closed.
+			return
+		}
+		if err := s.Reload(context.Background(), siteKey); err != nil {
+			log.Printf("Couldn't reload site %q after it changed: %v", siteKey, err)
+			return
+		}
+		log.Printf("Reloaded site %q after it changed", siteKey)
+	})
+	if err != nil {
+		ent.err = fmt.Errorf("site %q: %v", siteKey, err)
+		return
+	}
+	ent.svr = svr
+	ent.handler = svr.router()
+}
+
+// Reload reloads the Site entity with the given key from the store, and
+// starts serving it with a fresh cache. If the site can't be loaded, the
+// previously loaded copy (if any) continues to be served.
+func (s *Server) Reload(ctx context.Context, siteKey string) error {
+	ent := &siteEntry{ready: make(chan struct{})}
+	s.load(ctx, siteKey, ent)
+	if ent.err != nil {
+		return ent.err
+	}
+	s.mu.Lock()
+	old := s.sites[siteKey]
+	s.sites[siteKey] = ent
+	s.mu.Unlock()
+	if old != nil {
+		go func() {
+			<-old.ready
+			if old.svr != nil {
+				old.svr.close()
+			}
+		}()
+	}
+	return nil
+}
+
+// Close stops serving all sites: it stops watching for changes to templates
+// and content, releases the caches, and closes the store if it was opened by
+// the Server (rather than given with UseStore). The Server shouldn't be used
+// after Close.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	sites := s.sites
+	s.sites = make(map[string]*siteEntry)
+	s.mu.Unlock()
+	for _, ent := range sites {
+		<-ent.ready
+		if ent.svr != nil {
+			ent.svr.close()
+		}
+	}
+	if c, ok := s.store.(io.Closer); ok && s.options.store == nil {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("close store: %v", err)
+		}
+	}
+	return nil
+}
+
+// hostname lower-cases a host and strips any port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
 
-	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatalf("http.ListenAndServe: %v", err)
+// siteKeyForHost returns the key of the site to serve for a Host header.
+func (s *Server) siteKeyForHost(host string) string {
+	if key, ok := s.options.hostSites[hostname(host)]; ok {
+		return key
+	}
+	return s.defKey
+}
+
+// ServeHTTP serves a request for the site chosen by the Host header.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	siteKey := s.siteKeyForHost(r.Host)
+	ctx, canc := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer canc()
+	ent, err := s.site(ctx, siteKey)
+	if err != nil {
+		log.Printf("Couldn't load site for host %q: %v", r.Host, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
+	ent.handler.ServeHTTP(w, r)
 }
@@ -0,0 +1,620 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/andybalholm/brotli"
+)
+
+const testPageTemplate = `<title>{{.Title}}</title>{{markdown .Contents}}`
+
+// testSite returns a Site for tests, with a page template in a temporary
+// directory.
+func testSite(t *testing.T) *Site {
+	t.Helper()
+	tmpl := filepath.Join(t.TempDir(), "page.html")
+	if err := os.WriteFile(tmpl, []byte(testPageTemplate), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(%q) = %v", tmpl, err)
+	}
+	return &Site{
+		Key:          datastore.NameKey("Site", "test", nil),
+		URLBase:      "https://example.com/",
+		PageTemplate: tmpl,
+		AdminEmail:   "admin@example.com",
+		FeedTitle:    "Test feed",
+		TimeLocation: "UTC",
+	}
+}
+
+// testPages returns some pages for tests: two blog posts and a non-blog page.
+func testPages() []*Page {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []*Page{
+		{
+			Key:          datastore.NameKey("Page", "first", nil),
+			Title:        "First post",
+			Created:      t0,
+			LastModified: t0,
+			Published:    true,
+			Blog:         true,
+			Contents:     "Hello, *world*.",
+		},
+		{
+			Key:          datastore.NameKey("Page", "second", nil),
+			Title:        "Second post",
+			Created:      t0.Add(24 * time.Hour),
+			LastModified: t0.Add(24 * time.Hour),
+			Published:    true,
+			Blog:         true,
+			Contents:     "Hello again.",
+		},
+		{
+			Key:          datastore.NameKey("Page", "about", nil),
+			Title:        "About",
+			Created:      t0,
+			LastModified: t0,
+			Published:    true,
+			Contents:     "About this site.",
+		},
+	}
+}
+
+// newTestServer returns a Server for the test site, stored in memory.
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	opts = append([]Option{InMemoryStore(), SeedSite(testSite(t), testPages()...)}, opts...)
+	s, err := New(context.Background(), "test", opts...)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("Close() = %v", err)
+		}
+	})
+	return s
+}
+
+// get makes a GET request to the handler, and returns the response and body.
+func get(t *testing.T, h http.Handler, path string) (*http.Response, string) {
+	t.Helper()
+	return getWith(t, h, path)
+}
+
+// getWith is like get, but sets request headers, given as name, value pairs.
+func getWith(t *testing.T, h http.Handler, path string, header ...string) (*http.Response, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	h.ServeHTTP(w, r)
+	res := w.Result()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading body of %s: %v", path, err)
+	}
+	return res, string(body)
+}
+
+func TestServer(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/first", http.StatusOK, "Hello, <em>world</em>."},
+		{"/about", http.StatusOK, "<title>About</title>"},
+		{"/missing", http.StatusNotFound, ""},
+		{"/rss.xml", http.StatusOK, "Second post"},
+		{"/atom.xml", http.StatusOK, "Test feed"},
+		{"/sitemap.xml", http.StatusOK, "https://example.com/about"},
+		{"/latest", http.StatusFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, body := get(t, s, test.path)
+			if res.StatusCode != test.status {
+				t.Errorf("GET %s status = %d, want %d", test.path, res.StatusCode, test.status)
+			}
+			if !strings.Contains(body, test.contains) {
+				t.Errorf("GET %s body = %q, want it to contain %q", test.path, body, test.contains)
+			}
+		})
+	}
+
+	if res, _ := get(t, s, "/latest"); !strings.HasSuffix(res.Header.Get("Location"), "second") {
+		t.Errorf("GET /latest Location = %q, want the second post", res.Header.Get("Location"))
+	}
+}
+
+// flakyStore is a Store whose GetPage can be made to fail, or to wait.
+type flakyStore struct {
+	Store
+	gets atomic.Int64 // calls to GetPage
+
+	mu      sync.Mutex
+	err     error         // if not nil, returned by GetPage
+	release chan struct{} // if not nil, GetPage waits until it is closed
+}
+
+func (f *flakyStore) set(err error, release chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err, f.release = err, release
+}
+
+func (f *flakyStore) GetPage(ctx context.Context, key *datastore.Key) (*Page, error) {
+	f.gets.Add(1)
+	f.mu.Lock()
+	err, release := f.err, f.release
+	f.mu.Unlock()
+	if release != nil {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.Store.GetPage(ctx, key)
+}
+
+// newFlakyServer returns a test server using a flakyStore, caching pages for
+// ttl.
+func newFlakyServer(t *testing.T, ttl time.Duration) (*Server, *flakyStore) {
+	t.Helper()
+	fs := &flakyStore{Store: NewMemStore()}
+	return newTestServer(t, UseStore(fs), CacheTTL(PageRoutes, ttl)), fs
+}
+
+// siteCache returns the cache of the default site.
+func siteCache(t *testing.T, s *Server) *cache {
+	t.Helper()
+	ent, err := s.site(context.Background(), s.defKey)
+	if err != nil {
+		t.Fatalf("s.site() = %v", err)
+	}
+	return ent.svr.cache
+}
+
+func TestCacheServesStale(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	s, fs := newFlakyServer(t, ttl)
+	ctx := context.Background()
+	if _, body := get(t, s, "/first"); !strings.Contains(body, "Hello, <em>world</em>.") {
+		t.Fatalf("GET /first = %q, want the first version", body)
+	}
+
+	// Change the page behind saebr's back, so it isn't purged from the cache.
+	key := datastore.NameKey("Page", "first", datastore.NameKey("Site", "test", nil))
+	p, err := fs.Store.GetPage(ctx, key)
+	if err != nil {
+		t.Fatalf("GetPage(first) = %v", err)
+	}
+	p.Contents = "Changed."
+	if err := fs.Store.PutPage(ctx, p); err != nil {
+		t.Fatalf("PutPage(first) = %v", err)
+	}
+	time.Sleep(ttl + 50*time.Millisecond)
+
+	// While the refresh waits for the store, the stale copy is served, and
+	// further requests share the refresh rather than starting their own.
+	release := make(chan struct{})
+	fs.set(nil, release)
+	before := fs.gets.Load()
+	for range 3 {
+		if _, body := get(t, s, "/first"); !strings.Contains(body, "Hello, <em>world</em>.") {
+			t.Errorf("GET /first while refreshing = %q, want the stale copy", body)
+		}
+	}
+	eventually(t, "the refresh starts", func() bool { return fs.gets.Load() > before })
+	time.Sleep(50 * time.Millisecond)
+	if got := fs.gets.Load() - before; got != 1 {
+		t.Errorf("GetPage calls while refreshing = %d, want 1", got)
+	}
+	if st := siteCache(t, s).stats(); st.StaleHits != 3 {
+		t.Errorf("StaleHits = %d, want 3", st.StaleHits)
+	}
+
+	close(release)
+	waitForBody(t, s, "/first", "Changed.")
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	s, fs := newFlakyServer(t, time.Minute)
+	release := make(chan struct{})
+	fs.set(nil, release)
+	before := fs.gets.Load()
+
+	const n = 5
+	statuses := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/about", nil))
+			statuses[i] = w.Code
+		}()
+	}
+	eventually(t, "the fetch starts", func() bool { return fs.gets.Load() > before })
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d: status = %d, want 200", i, status)
+		}
+	}
+	if got := fs.gets.Load() - before; got != 1 {
+		t.Errorf("GetPage calls for %d concurrent misses = %d, want 1", n, got)
+	}
+}
+
+func TestCacheStoreError(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	s, fs := newFlakyServer(t, ttl)
+	get(t, s, "/first")
+	time.Sleep(ttl + 50*time.Millisecond)
+
+	// The stale copy is served while refreshing, and kept when the refresh
+	// fails.
+	fs.set(errors.New("store is having a bad day"), nil)
+	get(t, s, "/first")
+	c := siteCache(t, s)
+	eventually(t, "the refresh fails", func() bool { return c.stats().FetchErrors > 0 })
+
+	tests := []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/first", http.StatusOK, "Hello, <em>world</em>."},
+		{"/about", http.StatusServiceUnavailable, ""},
+		{"/missing", http.StatusServiceUnavailable, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, body := get(t, s, test.path)
+			if res.StatusCode != test.status {
+				t.Errorf("GET %s status = %d, want %d", test.path, res.StatusCode, test.status)
+			}
+			if !strings.Contains(body, test.contains) {
+				t.Errorf("GET %s body = %q, want it to contain %q", test.path, body, test.contains)
+			}
+		})
+	}
+
+	// Errors aren't cached.
+	fs.set(nil, nil)
+	if res, _ := get(t, s, "/about"); res.StatusCode != http.StatusOK {
+		t.Errorf("GET /about after the store recovers: status = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		path         string
+		cacheControl string
+		maxAge       time.Duration // for Expires; 0 if there should be none
+	}{
+		{"page default", nil, "/first", "public, max-age=60", time.Minute},
+		{"feed default", nil, "/rss.xml", "public, max-age=60", time.Minute},
+		{"not found", nil, "/missing", "public, max-age=60", time.Minute},
+		{"page TTL", []Option{CacheTTL(PageRoutes, 5*time.Minute)}, "/first", "public, max-age=300", 5 * time.Minute},
+		{"page TTL leaves feeds", []Option{CacheTTL(PageRoutes, 5*time.Minute)}, "/atom.xml", "public, max-age=60", time.Minute},
+		{"feed TTL", []Option{CacheTTL(FeedRoutes, time.Hour)}, "/feed.json", "public, max-age=3600", time.Hour},
+		{"index TTL", []Option{CacheTTL(IndexRoute, 2*time.Hour)}, "/index", "public, max-age=7200", 2 * time.Hour},
+		{"sitemap TTL", []Option{CacheTTL(SitemapRoute, 24*time.Hour)}, "/sitemap.xml", "public, max-age=86400", 24 * time.Hour},
+		{"zero TTL", []Option{CacheTTL(PageRoutes, 0)}, "/first", "no-cache", 0},
+		{"disabled", []Option{DisableCache()}, "/rss.xml", "no-cache", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, test.opts...)
+			res, _ := get(t, s, test.path)
+			if got := res.Header.Get("Cache-Control"); got != test.cacheControl {
+				t.Errorf("GET %s Cache-Control = %q, want %q", test.path, got, test.cacheControl)
+			}
+			expires := res.Header.Get("Expires")
+			if test.maxAge == 0 {
+				if expires != "" {
+					t.Errorf("GET %s Expires = %q, want none", test.path, expires)
+				}
+				return
+			}
+			exp, err := http.ParseTime(expires)
+			if err != nil {
+				t.Fatalf("GET %s Expires = %q: %v", test.path, expires, err)
+			}
+			if d := time.Until(exp) - test.maxAge; d < -5*time.Second || d > time.Second {
+				t.Errorf("GET %s Expires = %v, want about %v from now", test.path, exp, test.maxAge)
+			}
+		})
+	}
+}
+
+// longPage returns a page long enough to be worth compressing.
+func longPage() *Page {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &Page{
+		Key:          datastore.NameKey("Page", "long", nil),
+		Title:        "Long page",
+		Created:      t0,
+		LastModified: t0,
+		Published:    true,
+		Contents:     strings.Repeat("All work and no play makes Jack a dull boy.\n\n", 50),
+	}
+}
+
+// decodeBody decodes a response body with the given Content-Encoding.
+func decodeBody(t *testing.T, enc, body string) string {
+	t.Helper()
+	var r io.Reader = strings.NewReader(body)
+	switch enc {
+	case "":
+		return body
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("gzip.NewReader() = %v", err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(r)
+	default:
+		t.Fatalf("unknown Content-Encoding %q", enc)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s body: %v", enc, err)
+	}
+	return string(b)
+}
+
+func TestContentEncoding(t *testing.T) {
+	s := newTestServer(t, SeedSite(testSite(t), append(testPages(), longPage())...))
+	_, want := get(t, s, "/long")
+	if len(want) < minCompressSize {
+		t.Fatalf("GET /long is only %d bytes; make the page longer", len(want))
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		want           string // Content-Encoding
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"br; q=0, gzip;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0", ""},
+		{"deflate", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.acceptEncoding, func(t *testing.T) {
+			res, body := getWith(t, s, "/long", "Accept-Encoding", test.acceptEncoding)
+			if got := res.Header.Get("Content-Encoding"); got != test.want {
+				t.Errorf("Content-Encoding = %q, want %q", got, test.want)
+			}
+			if got := res.Header.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if got := decodeBody(t, test.want, body); got != want {
+				t.Errorf("decoded body = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Small responses aren't compressed, so don't vary.
+	res, _ := getWith(t, s, "/about", "Accept-Encoding", "gzip, br")
+	if got := res.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("GET /about Content-Encoding = %q, want none", got)
+	}
+	if got := res.Header.Get("Vary"); got != "" {
+		t.Errorf("GET /about Vary = %q, want none", got)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	s := newTestServer(t, SeedSite(testSite(t), append(testPages(), longPage())...))
+	res, _ := get(t, s, "/long")
+	etag := res.Header.Get("ETag")
+	res, _ = getWith(t, s, "/long", "Accept-Encoding", "gzip")
+	gzipETag := res.Header.Get("ETag")
+	if etag == "" || gzipETag == "" || etag == gzipETag {
+		t.Fatalf("ETags = %q (identity), %q (gzip); want two different ETags", etag, gzipETag)
+	}
+
+	tests := []struct {
+		ifNoneMatch    string
+		acceptEncoding string
+		status         int
+	}{
+		{etag, "", http.StatusNotModified},
+		{"W/" + etag, "", http.StatusNotModified},
+		{`"other", ` + etag, "", http.StatusNotModified},
+		{"*", "", http.StatusNotModified},
+		{`"other"`, "", http.StatusOK},
+		{gzipETag, "gzip", http.StatusNotModified},
+		{etag, "gzip", http.StatusOK},
+		{gzipETag, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.ifNoneMatch+" "+test.acceptEncoding, func(t *testing.T) {
+			res, body := getWith(t, s, "/long", "If-None-Match", test.ifNoneMatch, "Accept-Encoding", test.acceptEncoding)
+			if res.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, test.status)
+			}
+			if test.status == http.StatusNotModified && body != "" {
+				t.Errorf("body = %q, want none", body)
+			}
+		})
+	}
+}
+
+func TestETagChanges(t *testing.T) {
+	site := testSite(t)
+	writeFile(t, site.PageTemplate, `<title>{{.Title}}</title>{{markdown .Contents}}{{with .NextPage}}Next: {{.Title}}{{end}}`)
+	s := newTestServer(t, SeedSite(site, testPages()...))
+
+	// notModified reports whether /first is unchanged since etag, and returns
+	// the current ETag.
+	notModified := func(etag string) (bool, string) {
+		t.Helper()
+		res, _ := getWith(t, s, "/first", "If-None-Match", etag)
+		return res.StatusCode == http.StatusNotModified, res.Header.Get("ETag")
+	}
+	res, _ := get(t, s, "/first")
+	etag := res.Header.Get("ETag")
+	if same, _ := notModified(etag); !same {
+		t.Fatalf("GET /first with If-None-Match: %s wasn't 304", etag)
+	}
+
+	// Only the neighbouring post changes.
+	res = postEdit(t, s, "second", url.Values{
+		"Title":     {"Second post, renamed"},
+		"Contents":  {"Hello again."},
+		"Published": {"on"},
+		"Blog":      {"on"},
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST /edit/second status = %d, want 200", res.StatusCode)
+	}
+	same, newETag := notModified(etag)
+	if same || newETag == etag {
+		t.Errorf("after renaming the next post, /first ETag = %s, want it changed from %s", newETag, etag)
+	}
+	etag = newETag
+
+	// Only the template changes.
+	writeFile(t, site.PageTemplate, `<title>{{.Title}}</title>{{markdown .Contents}}<footer>v2</footer>`)
+	waitForBody(t, s, "/first", "<footer>v2</footer>")
+	if same, newETag := notModified(etag); same || newETag == etag {
+		t.Errorf("after changing the template, /first ETag = %s, want it changed from %s", newETag, etag)
+	}
+}
+
+func TestSeedSite(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	site, err := s.store.GetSite(ctx, datastore.NameKey("Site", "test", nil))
+	if err != nil {
+		t.Fatalf("GetSite() = %v", err)
+	}
+	if site.AdminEmail != "admin@example.com" || len(site.Secret) < 16 {
+		t.Errorf("seeded site = %+v, want AdminEmail from the seed and a generated Secret", site)
+	}
+	first, err := s.store.GetPage(ctx, datastore.NameKey("Page", "first", site.Key))
+	if err != nil {
+		t.Fatalf("GetPage(first) = %v", err)
+	}
+	if want := datastore.NameKey("Page", "second", site.Key); !first.Next.Equal(want) {
+		t.Errorf("first.Next = %v, want %v", first.Next, want)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	site := testSite(t)
+	writeFile(t, site.PageTemplate, `<title>{{.Title}}</title>{{markdown .Contents}}`+
+		`<a href="{{.URL "/index"}}">Index</a>`+
+		`{{with .NextPage}}<a href="{{$.URL (print "/" .Key.Name)}}">Next</a>{{end}}`)
+	s, err := New(context.Background(), "test", InMemoryStore(), SeedSite(site, testPages()...), PathPrefix("/blog/"))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+		links    []string
+	}{
+		{"/blog/first", http.StatusOK, "", []string{`href="/blog/index"`, `href="/blog/second"`}},
+		{"/first", http.StatusNotFound, "", nil},
+		{"/blog", http.StatusMovedPermanently, "/blog/", nil},
+		{"/blog/latest", http.StatusFound, "/blog/second", nil},
+		{"/blog/index", http.StatusOK, "", []string{`href="/blog/first"`, `href="/blog/second"`}},
+		{"/blog/edit/first", http.StatusFound, "/blog/login?redirect_to=%2Fblog%2Fedit%2Ffirst", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, body := get(t, s, test.path)
+			if res.StatusCode != test.status {
+				t.Errorf("GET %s status = %d, want %d", test.path, res.StatusCode, test.status)
+			}
+			if got := res.Header.Get("Location"); got != test.location {
+				t.Errorf("GET %s Location = %q, want %q", test.path, got, test.location)
+			}
+			for _, link := range test.links {
+				if !strings.Contains(body, link) {
+					t.Errorf("GET %s = %q, want it to contain %s", test.path, body, link)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplateSiteInfo(t *testing.T) {
+	site := testSite(t)
+	site.Secret = "0123456789abcdef-secret"
+	writeFile(t, site.PageTemplate, `{{.Site.FeedTitle}} {{printf "%+v" .Site}}`)
+	s, err := New(context.Background(), "test", InMemoryStore(), SeedSite(site, testPages()...))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	defer s.Close()
+
+	_, body := get(t, s, "/about")
+	if !strings.Contains(body, site.FeedTitle) {
+		t.Errorf("GET /about = %q, want it to contain the feed title %q", body, site.FeedTitle)
+	}
+	for _, secret := range []string{site.Secret, site.AdminEmail} {
+		if strings.Contains(body, secret) {
+			t.Errorf("GET /about = %q, reveals %q", body, secret)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ListenAddr sets the TCP address Run listens on, e.g. "localhost:8080". The
+// default is ":$PORT", or ":8080" if the PORT env var is empty.
+func ListenAddr(addr string) Option {
+	return func(o *options) { o.listenAddr = addr }
+}
+
+// UnixSocket makes Run listen on a unix socket at the given path, instead of
+// TCP. Any existing file at the path is removed first.
+func UnixSocket(path string) Option {
+	return func(o *options) { o.unixSocket = path }
+}
+
+// TLSCertKey makes Run serve HTTPS, using the certificate and private key in
+// the given PEM files. The default is to serve unencrypted HTTP.
+func TLSCertKey(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.tlsCertFile = certFile
+		o.tlsKeyFile = keyFile
+	}
+}
+
+// HTTPTimeouts sets the read, write, and idle timeouts for the HTTP server
+// started by Run. The defaults are 30 seconds, 60 seconds, and 120 seconds.
+// Zero means no timeout.
+func HTTPTimeouts(read, write, idle time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout = read
+		o.writeTimeout = write
+		o.idleTimeout = idle
+	}
+}
+
+// ShutdownTimeout sets how long Run waits for in-flight requests to finish
+// after receiving SIGINT or SIGTERM. The default is 10 seconds.
+func ShutdownTimeout(d time.Duration) Option {
+	return func(o *options) { o.shutdownTimeout = d }
+}
+
+// listen creates the listener configured by the options.
+func listen(o *options) (net.Listener, error) {
+	if o.unixSocket != "" {
+		if err := os.Remove(o.unixSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", o.unixSocket)
+	}
+	addr := o.listenAddr
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+			log.Printf("Defaulting to port %s", port)
+		}
+		addr = ":" + port
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Run runs saebr.
+//
+// saebr makes the following assumptions:
+//
+//   - It's running on Google App Engine, so runs as an unencrypted HTTP
+//     server. (App Engine can provide HTTPS and HTTP/2.) Use TLSCertKey to
+//     serve HTTPS directly.
+//   - Run can exit the program (using log.Fatal) if an error occurs.
+//   - Serving port is given by the PORT env var, or if empty assumes 8080.
+//     ListenAddr and UnixSocket override this.
+//
+// On SIGINT or SIGTERM, Run stops accepting connections, waits for in-flight
+// requests to finish (see ShutdownTimeout), and then returns.
+//
+// To serve saebr some other way, use New.
+func Run(siteKey string, opts ...Option) {
+	svr, err := New(context.Background(), siteKey, opts...)
+	if err != nil {
+		log.Fatalf("Couldn't create server: %v", err)
+	}
+	o := svr.options
+
+	ln, err := listen(o)
+	if err != nil {
+		log.Fatalf("Couldn't listen: %v", err)
+	}
+	hs := &http.Server{
+		Handler:           svr,
+		ReadHeaderTimeout: o.readTimeout,
+		ReadTimeout:       o.readTimeout,
+		WriteTimeout:      o.writeTimeout,
+		IdleTimeout:       o.idleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", ln.Addr())
+		if o.tlsCertFile != "" {
+			errCh <- hs.ServeTLS(ln, o.tlsCertFile, o.tlsKeyFile)
+			return
+		}
+		errCh <- hs.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		log.Fatalf("http.Server.Serve: %v", err)
+
+	case <-ctx.Done():
+		stop() // a second signal kills the program as usual
+	}
+
+	log.Print("Shutting down")
+	sctx, canc := context.WithTimeout(context.Background(), o.shutdownTimeout)
+	defer canc()
+	if err := hs.Shutdown(sctx); err != nil {
+		log.Printf("Couldn't shut down gracefully: %v", err)
+	}
+	if err := svr.Close(); err != nil {
+		log.Printf("Couldn't close server: %v", err)
+	}
+}
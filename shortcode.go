@@ -0,0 +1,235 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Shortcode is a shortcode that can be used in Markdown contents.
+//
+// Shortcodes are written {{< name key="value" key2=value2 >}}. Paired
+// shortcodes take inner contents, written {{< name ... >}}inner
+// contents{{< /name >}}, and may be nested. To write a shortcode literally
+// (e.g. in a code block), use {{</* name ... */>}}.
+type Shortcode struct {
+	// Func expands one use of the shortcode.
+	Func ShortcodeFunc
+
+	// Paired is true if the shortcode takes inner contents, in which case
+	// the closing tag is required.
+	Paired bool
+}
+
+// ShortcodeFunc expands one use of a shortcode into HTML.
+type ShortcodeFunc func(call *ShortcodeCall) (template.HTML, error)
+
+// ShortcodeCall describes one use of a shortcode.
+type ShortcodeCall struct {
+	Name  string
+	Args  map[string]string
+	Inner string // contents between the opening and closing tags, if paired
+
+	render func(string) (template.HTML, error)
+}
+
+// Markdown renders Markdown (such as Inner) the same way as the page it is
+// in.
+func (c *ShortcodeCall) Markdown(s string) (template.HTML, error) {
+	return c.render(s)
+}
+
+// TemplateShortcode returns a ShortcodeFunc that executes an html/template with
+// the *ShortcodeCall, so the template can use {{.Args.key}}, {{.Inner}}, and
+// {{.Markdown .Inner}}. It panics if the template doesn't parse.
+func TemplateShortcode(text string) ShortcodeFunc {
+	t := template.Must(template.New("shortcode").Parse(text))
+	return func(call *ShortcodeCall) (template.HTML, error) {
+		b := new(strings.Builder)
+		if err := t.Execute(b, call); err != nil {
+			return "", err
+		}
+		return template.HTML(b.String()), nil
+	}
+}
+
+// Built-in shortcodes - can be overridden
+var builtinShortcodes = map[string]Shortcode{
+	"figure": {Func: TemplateShortcode(`<figure class="center-align">` +
+		`{{with .Args.link}}<a href="{{.}}">{{end}}` +
+		`<img class="responsive-img" src="{{.Args.src}}" alt="{{or .Args.alt .Args.caption}}">` +
+		`{{if .Args.link}}</a>{{end}}` +
+		`{{with .Args.caption}}<figcaption>{{.}}</figcaption>{{end}}` +
+		`</figure>`)},
+	"youtube": {Func: TemplateShortcode(`<div class="video-container">` +
+		`<iframe src="https://www.youtube-nocookie.com/embed/{{.Args.id}}" title="{{or .Args.title "YouTube video"}}" ` +
+		`frameborder="0" allow="encrypted-media; picture-in-picture" allowfullscreen></iframe>` +
+		`</div>`)},
+	"callout": {Func: TemplateShortcode(`<div class="card-panel callout callout-{{or .Args.type "note"}}">` +
+		`{{with .Args.title}}<strong>{{.}}</strong>{{end}}` +
+		`{{.Markdown .Inner}}` +
+		`</div>`), Paired: true},
+	"gist": {Func: TemplateShortcode(`<script src="https://gist.github.com/{{.Args.user}}/{{.Args.id}}.js{{with .Args.file}}?file={{.}}{{end}}"></script>`)},
+}
+
+// Matches an opening tag, a closing tag, or an escaped tag.
+var shortcodeRE = regexp.MustCompile(`\{\{<(/\*)?\s*(/)?([A-Za-z][\w-]*)(.*?)\s*(\*/)?>\}\}`)
+
+var scArgRE = regexp.MustCompile(`([\w-]+)=("(?:[^"\\]|\\.)*"|\S+)`)
+
+// shortcodeTag is one match of shortcodeRE.
+type shortcodeTag struct {
+	start, end int // of the whole tag
+	name       string
+	args       string
+	closing    bool
+	escaped    bool
+	unescaped  string // for escaped tags, the tag without the comment markers
+}
+
+// nextShortcodeTag finds the first shortcode tag in s.
+func nextShortcodeTag(s string) (shortcodeTag, bool) {
+	loc := shortcodeRE.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return shortcodeTag{}, false
+	}
+	t := shortcodeTag{
+		start:   loc[0],
+		end:     loc[1],
+		name:    s[loc[6]:loc[7]],
+		args:    s[loc[8]:loc[9]],
+		closing: loc[4] >= 0,
+		escaped: loc[2] >= 0 && loc[10] >= 0,
+	}
+	if t.escaped {
+		t.unescaped = "{{< " + strings.TrimSpace(s[loc[3]:loc[10]]) + " >}}"
+	}
+	return t, true
+}
+
+// findClosing finds the tag closing a paired shortcode named name, whose
+// opening tag is just before s, taking nested uses of the same shortcode
+// into account. It returns the start and end of the closing tag.
+func findClosing(s, name string) (start, end int, ok bool) {
+	depth := 1
+	for off := 0; ; {
+		t, ok := nextShortcodeTag(s[off:])
+		if !ok {
+			return 0, 0, false
+		}
+		if !t.escaped && t.name == name {
+			if t.closing {
+				depth--
+			} else {
+				depth++
+			}
+			if depth == 0 {
+				return off + t.start, off + t.end, true
+			}
+		}
+		off += t.end
+	}
+}
+
+// parseShortcodeArgs parses key=value pairs, where values may be quoted.
+func parseShortcodeArgs(s string) (map[string]string, error) {
+	args := make(map[string]string)
+	for _, m := range scArgRE.FindAllStringSubmatch(s, -1) {
+		v := m[2]
+		if strings.HasPrefix(v, `"`) {
+			uq, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for %s: %v", m[1], err)
+			}
+			v = uq
+		}
+		args[m[1]] = v
+	}
+	return args, nil
+}
+
+// expandShortcodes replaces shortcodes in Markdown contents with
+// placeholders, and returns the new contents together with the output of
+// each shortcode (in placeholder order). Unknown shortcodes are left alone.
+// A shortcode that fails is replaced with an error (shown only in previews)
+// and left as it was written.
+func (o *options) expandShortcodes(src string, render func(string) (template.HTML, error)) (string, []template.HTML) {
+	var out strings.Builder
+	var expanded []template.HTML
+	for {
+		t, ok := nextShortcodeTag(src)
+		if !ok {
+			out.WriteString(src)
+			return out.String(), expanded
+		}
+		tag := src[t.start:t.end]
+		out.WriteString(src[:t.start])
+		src = src[t.end:]
+
+		sc, known := o.shortcodes[t.name]
+		switch {
+		case t.escaped:
+			out.WriteString(t.unescaped)
+			continue
+		case !known:
+			o.logUnknownShortcode(t.name)
+			out.WriteString(tag)
+			continue
+		case t.closing:
+			// Without a matching opening tag.
+			out.WriteString(tag)
+			continue
+		}
+
+		call := &ShortcodeCall{Name: t.name, render: render}
+		rest := src
+		h, err := func() (template.HTML, error) {
+			args, err := parseShortcodeArgs(t.args)
+			if err != nil {
+				return "", err
+			}
+			call.Args = args
+			if sc.Paired {
+				start, end, ok := findClosing(src, t.name)
+				if !ok {
+					return "", fmt.Errorf("missing {{< /%s >}}", t.name)
+				}
+				call.Inner = strings.TrimSpace(src[:start])
+				src = src[end:]
+			}
+			return sc.Func(call)
+		}()
+		if err != nil {
+			out.WriteString(placeholder(len(expanded)) + tag)
+			expanded = append(expanded, template.HTML(previewError("Shortcode "+t.name, err)))
+			src = rest
+			continue
+		}
+		out.WriteString(placeholder(len(expanded)))
+		expanded = append(expanded, h)
+	}
+}
+
+// logUnknownShortcode logs that a shortcode is unknown, once per name.
+func (o *options) logUnknownShortcode(name string) {
+	if _, logged := o.unknownShortcodes.LoadOrStore(name, true); !logged {
+		log.Printf("Unknown shortcode %q", name)
+	}
+}
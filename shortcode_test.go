@@ -0,0 +1,56 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestExpandShortcodes(t *testing.T) {
+	o := newOptions([]Option{Shortcodes(map[string]Shortcode{
+		"box": {Func: func(c *ShortcodeCall) (template.HTML, error) {
+			return template.HTML("[" + c.Inner + "]"), nil
+		}, Paired: true},
+		"hr": {Func: func(c *ShortcodeCall) (template.HTML, error) {
+			return "<hr>", nil
+		}},
+	})})
+	render := func(s string) (template.HTML, error) { return template.HTML(s), nil }
+
+	tests := []struct {
+		name, src, want string
+	}{
+		{"unpaired", `a {{< hr >}} b`, `a <hr> b`},
+		{"unpaired does not consume", `{{< hr >}} x {{< /hr >}}`, `<hr> x {{< /hr >}}`},
+		{"paired", `{{< box >}}in{{< /box >}}`, `[in]`},
+		{"nested", `{{< box >}}a {{< box >}}b{{< /box >}} c{{< /box >}} d`, `[a {{< box >}}b{{< /box >}} c] d`},
+		{"siblings", `{{< box >}}a{{< /box >}}{{< box >}}b{{< /box >}}`, `[a][b]`},
+		{"escaped", `{{</* box x=1 */>}}`, `{{< box x=1 >}}`},
+		{"unknown", `{{< nope >}}`, `{{< nope >}}`},
+		{"missing close", `{{< box >}}in`, previewOnlyStart},
+		{"bad argument", `{{< hr x="\q" >}}`, previewOnlyStart},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, subs := o.expandShortcodes(test.src, render)
+			got := replacePlaceholders(s, subs)
+			if !strings.Contains(got, test.want) {
+				t.Errorf("expandShortcodes(%q) = %q, want it to contain %q", test.src, got, test.want)
+			}
+		})
+	}
+}
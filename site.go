@@ -15,7 +15,13 @@
 package saebr
 
 import (
-	"html/template"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/sessions"
@@ -29,6 +35,7 @@ type Site struct {
 
 	URLBase           string `datastore:",noindex"`
 	PageTemplate      string `datastore:",noindex"`
+	TemplateDir       string `datastore:",noindex"`
 	AdminEmail        string `datastore:",noindex"`
 	Secret            string `datastore:",noindex"`
 	WebSignInClientID string `datastore:",noindex"`
@@ -39,8 +46,92 @@ type Site struct {
 	FeedCopyright     string `datastore:",noindex"`
 	TimeLocation      string `datastore:",noindex"`
 
-	pageTmpl      *template.Template
-	pageTmplMtime time.Time
-	cookieStore   *sessions.CookieStore
-	timeLoc       *time.Location
+	pageTmpl    atomic.Pointer[pageTemplate]
+	tmplMu      sync.Mutex
+	tmplStatus  templateStatus // guarded by tmplMu
+	cookieStore *sessions.CookieStore
+	timeLoc     *time.Location
+}
+
+// siteSeed is the content of a site to create, given by SeedSite.
+type siteSeed struct {
+	site  *Site
+	pages []*Page
+}
+
+// loadSite loads the Site with the given key from the store, creating it (see
+// createSite) if it doesn't exist, and then prepares it for serving.
+func loadSite(ctx context.Context, store Store, siteKey string, o *options) (*Site, error) {
+	key := datastore.NameKey("Site", siteKey, nil)
+	site, err := store.GetSite(ctx, key)
+	if err != nil {
+		if err != ErrNotFound {
+			return nil, fmt.Errorf("fetch site object: %v", err)
+		}
+		if site, err = createSite(ctx, store, key, o); err != nil {
+			return nil, err
+		}
+	}
+	if len(site.Secret) < 16 {
+		return nil, errors.New("insufficient secret (len < 16)")
+	}
+	loc, err := time.LoadLocation(site.TimeLocation)
+	if err != nil {
+		return nil, fmt.Errorf("load time location: %v", err)
+	}
+	site.timeLoc = loc
+	site.cookieStore = sessions.NewCookieStore([]byte(site.Secret))
+	if err := site.reloadTemplate(o.templateFuncs); err != nil {
+		return nil, err
+	}
+	return site, nil
+}
+
+// createSite creates the Site with the given key in the store, from its seed
+// if there is one, or with placeholder values otherwise.
+func createSite(ctx context.Context, store Store, key *datastore.Key, o *options) (*Site, error) {
+	seed, seeded := o.seedSites[key.Name]
+	site := &Site{Key: key}
+	if seeded {
+		site = cloneSite(seed.site)
+		site.Key = key
+	} else {
+		// Fill in some sensible defaults
+		site.AdminEmail = "your.google.account.email.address@example.com"
+		site.FeedAuthor = "Your Name"
+		site.FeedCopyright = "Copyright © Your Name"
+		site.FeedDescription = "Description for feeds"
+		site.FeedSubtitle = "Subtitle for feeds"
+		site.FeedTitle = "Title for feeds"
+		site.PageTemplate = "your_page_template.html"
+		site.URLBase = "https://your.site.example.com/"
+		site.WebSignInClientID = "a web sign-in client ID - typically a number, then some base64 encoded data, followed by .apps.googleusercontent.com"
+	}
+	if site.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate a secret: %v", err)
+		}
+		site.Secret = base64.StdEncoding.EncodeToString(secret)
+	}
+	if site.TimeLocation == "" {
+		site.TimeLocation = time.Local.String()
+	}
+	if err := store.PutSite(ctx, site); err != nil {
+		return nil, fmt.Errorf("create a new Site entity: %v", err)
+	}
+	if !seeded || len(seed.pages) == 0 {
+		return site, nil
+	}
+	for _, p := range seed.pages {
+		p = clonePage(p)
+		p.Key = datastore.NameKey("Page", p.Key.Name, key)
+		if err := store.PutPage(ctx, p); err != nil {
+			return nil, fmt.Errorf("create page %q: %v", p.Key.Name, err)
+		}
+	}
+	if _, err := store.Relink(ctx, key); err != nil {
+		return nil, fmt.Errorf("link seeded posts: %v", err)
+	}
+	return site, nil
 }
@@ -19,8 +19,6 @@ import (
 	"strings"
 	"text/template"
 	"time"
-
-	"cloud.google.com/go/datastore"
 )
 
 var sitemapTmpl = template.Must(template.New("sitemap.xml").Parse(`<?xml version="1.0" encoding="UTF-8"?>
@@ -40,13 +38,8 @@ var sitemapTmpl = template.Must(template.New("sitemap.xml").Parse(`<?xml version
 </urlset>`))
 
 func (s *server) fetchSitemap(ctx context.Context, _ map[string]string) (content, error) {
-	q := datastore.NewQuery("Page").
-		Ancestor(s.site.Key).
-		FilterField("Published", "=", true).
-		Project("Created", "LastModified")
-
-	var pages []*Page
-	if _, err := s.client.GetAll(ctx, q, &pages); err != nil {
+	pages, err := s.store.QueryPages(ctx, s.site.Key, PageQuery{TimesOnly: true})
+	if err != nil {
 		return nil, err
 	}
 
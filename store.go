@@ -0,0 +1,161 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrNotFound is returned by a Store when the requested entity doesn't exist.
+var ErrNotFound = errors.New("no such entity")
+
+// Store is the interface to the storage of Site and Page entities. Pages are
+// keyed by a name key whose parent is the key of the Site they belong to.
+type Store interface {
+	// GetSite loads the Site with the given key. It returns ErrNotFound if
+	// there is no such Site.
+	GetSite(ctx context.Context, key *datastore.Key) (*Site, error)
+
+	// PutSite saves the Site, creating or overwriting it.
+	PutSite(ctx context.Context, site *Site) error
+
+	// GetPage loads the Page with the given key. It returns ErrNotFound if
+	// there is no such Page.
+	GetPage(ctx context.Context, key *datastore.Key) (*Page, error)
+
+	// GetPages loads the Pages with the given keys in one go. The result has
+	// one element per key, which is nil if there is no such Page.
+	GetPages(ctx context.Context, keys []*datastore.Key) ([]*Page, error)
+
+	// PutPage saves the Page, creating or overwriting it.
+	PutPage(ctx context.Context, page *Page) error
+
+	// DeletePage deletes the Page with the given key. Deleting a page that
+	// doesn't exist is not an error.
+	DeletePage(ctx context.Context, key *datastore.Key) error
+
+	// QueryPages returns the published pages of a site matching the query.
+	QueryPages(ctx context.Context, site *datastore.Key, q PageQuery) ([]*Page, error)
+
+	// Relink checks and fixes the Prev/Next keys of all published blog posts
+	// of a site, in a single transaction. It returns the keys of the pages
+	// that were changed.
+	Relink(ctx context.Context, site *datastore.Key) ([]*datastore.Key, error)
+}
+
+// changeNotifier is implemented by Stores whose contents can change other
+// than through the Store (such as dirStore), so that stale copies can be
+// purged.
+type changeNotifier interface {
+	// notifyChanges calls f with a description of each change, until
+	// cancelled.
+	notifyChanges(f func(storeChange)) (cancel func())
+}
+
+// storeChange describes a change made other than through the Store.
+type storeChange struct {
+	site  bool     // the Site changed
+	pages []string // names of pages that changed
+}
+
+// PageQuery describes a query for the published pages of a site.
+type PageQuery struct {
+	// BlogOnly restricts the results to pages with Blog = true.
+	BlogOnly bool
+
+	// Order is "Created" for oldest first, "-Created" for newest first, or
+	// empty for any order.
+	Order string
+
+	// Limit is the maximum number of pages to return. 0 means no limit.
+	Limit int
+
+	// TimesOnly indicates only Key, Created, and LastModified are needed.
+	TimesOnly bool
+
+	// KeysOnly indicates only Key is needed. Unlike TimesOnly, this needs no
+	// Datastore index beyond those used for the filters and order.
+	KeysOnly bool
+}
+
+// projectPage returns the parts of p needed by the query, or p itself if
+// all of it is needed.
+func projectPage(p *Page, q PageQuery) *Page {
+	switch {
+	case q.KeysOnly:
+		return &Page{Key: p.Key}
+	case q.TimesOnly:
+		return &Page{
+			Key:          p.Key,
+			Created:      p.Created,
+			LastModified: p.LastModified,
+		}
+	}
+	return p
+}
+
+// relinkPages sets the Prev/Next keys of pages (which should be sorted in
+// ascending Created order), and returns the pages that were changed.
+func relinkPages(pages []*Page) []*Page {
+	N := len(pages)
+	if N == 0 {
+		return nil
+	}
+
+	// Set of slice indexes that were wrong, to write back
+	upd := make(map[int]struct{})
+
+	// First page must have Prev = nil
+	if pages[0].Prev != nil {
+		pages[0].Prev = nil
+		upd[0] = struct{}{}
+	}
+	// Last page must have Next = nil
+	if pages[N-1].Next != nil {
+		pages[N-1].Next = nil
+		upd[N-1] = struct{}{}
+	}
+	// Then set prev/next for the middle
+	for i := range pages[:N-1] {
+		if k := pages[i].Key; !pages[i+1].Prev.Equal(k) {
+			pages[i+1].Prev = k
+			upd[i+1] = struct{}{}
+		}
+		if k := pages[i+1].Key; !pages[i].Next.Equal(k) {
+			pages[i].Next = k
+			upd[i] = struct{}{}
+		}
+	}
+
+	changed := make([]*Page, 0, len(upd))
+	for i, p := range pages {
+		if _, ok := upd[i]; ok {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+// pageKeys returns the keys of the pages.
+func pageKeys(pages []*Page) []*datastore.Key {
+	keys := make([]*datastore.Key, 0, len(pages))
+	for _, p := range pages {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// testStores returns each of the Stores that can be tested hermetically.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "saebr.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltStore() = %v", err)
+	}
+	t.Cleanup(func() { bs.(*boltStore).Close() })
+	return map[string]Store{
+		"memStore":  NewMemStore(),
+		"boltStore": bs,
+	}
+}
+
+// putTestPages puts the test pages, plus an unpublished page, in site.
+func putTestPages(t *testing.T, st Store, site *datastore.Key) {
+	t.Helper()
+	ctx := context.Background()
+	pages := append(testPages(), &Page{
+		Key:     datastore.NameKey("Page", "draft", nil),
+		Title:   "Draft",
+		Created: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC),
+		Blog:    true,
+	})
+	for _, p := range pages {
+		p.Key.Parent = site
+		if err := st.PutPage(ctx, p); err != nil {
+			t.Fatalf("PutPage(%v) = %v", p.Key, err)
+		}
+	}
+}
+
+// names returns the key names of the pages, or "<nil>" for nil pages.
+func names(pages []*Page) []string {
+	ns := make([]string, 0, len(pages))
+	for _, p := range pages {
+		if p == nil {
+			ns = append(ns, "<nil>")
+			continue
+		}
+		ns = append(ns, p.Key.Name)
+	}
+	return ns
+}
+
+func TestStoreGetPut(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			siteKey := datastore.NameKey("Site", "test", nil)
+			if _, err := st.GetSite(ctx, siteKey); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetSite() before PutSite = %v, want ErrNotFound", err)
+			}
+			site := testSite(t)
+			if err := st.PutSite(ctx, site); err != nil {
+				t.Fatalf("PutSite() = %v", err)
+			}
+			got, err := st.GetSite(ctx, siteKey)
+			if err != nil {
+				t.Fatalf("GetSite() = %v", err)
+			}
+			if got.AdminEmail != site.AdminEmail || got.FeedTitle != site.FeedTitle {
+				t.Errorf("GetSite() = %+v, want %+v", got, site)
+			}
+
+			putTestPages(t, st, siteKey)
+			key := datastore.NameKey("Page", "first", siteKey)
+			p, err := st.GetPage(ctx, key)
+			if err != nil {
+				t.Fatalf("GetPage(first) = %v", err)
+			}
+			if p.Title != "First post" || p.Contents != "Hello, *world*." || !p.Created.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("GetPage(first) = %+v, want the first test page", p)
+			}
+
+			// Changing the returned page doesn't change the stored page.
+			p.Title = "Changed"
+			if p, _ := st.GetPage(ctx, key); p.Title != "First post" {
+				t.Errorf("GetPage(first) after changing a copy: Title = %q, want %q", p.Title, "First post")
+			}
+
+			keys := []*datastore.Key{
+				key,
+				datastore.NameKey("Page", "missing", siteKey),
+				datastore.NameKey("Page", "about", siteKey),
+			}
+			pages, err := st.GetPages(ctx, keys)
+			if err != nil {
+				t.Fatalf("GetPages() = %v", err)
+			}
+			if got, want := names(pages), []string{"first", "<nil>", "about"}; !slices.Equal(got, want) {
+				t.Errorf("GetPages() = %v, want %v", got, want)
+			}
+
+			if err := st.DeletePage(ctx, key); err != nil {
+				t.Fatalf("DeletePage(first) = %v", err)
+			}
+			if _, err := st.GetPage(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetPage(first) after DeletePage = %v, want ErrNotFound", err)
+			}
+			if err := st.DeletePage(ctx, key); err != nil {
+				t.Errorf("DeletePage(first) again = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestStoreQueryPages(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		q    PageQuery
+		want []string
+	}{
+		{PageQuery{Order: "Created"}, []string{"about", "first", "second"}},
+		{PageQuery{BlogOnly: true, Order: "Created"}, []string{"first", "second"}},
+		{PageQuery{BlogOnly: true, Order: "-Created"}, []string{"second", "first"}},
+		{PageQuery{BlogOnly: true, Order: "-Created", Limit: 1}, []string{"second"}},
+		{PageQuery{BlogOnly: true, Order: "-Created", Limit: 1, TimesOnly: true}, []string{"second"}},
+		{PageQuery{BlogOnly: true, Order: "-Created", Limit: 1, KeysOnly: true}, []string{"second"}},
+	}
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			site := datastore.NameKey("Site", "test", nil)
+			other := datastore.NameKey("Site", "other", nil)
+			putTestPages(t, st, site)
+			putTestPages(t, st, other)
+			if err := st.DeletePage(ctx, datastore.NameKey("Page", "second", other)); err != nil {
+				t.Fatalf("DeletePage() = %v", err)
+			}
+
+			for _, test := range tests {
+				pages, err := st.QueryPages(ctx, site, test.q)
+				if err != nil {
+					t.Fatalf("QueryPages(%+v) = %v", test.q, err)
+				}
+				got := names(pages)
+				if test.q.Order == "Created" && len(got) == 3 {
+					// about and first were created at the same time.
+					slices.Sort(got[:2])
+				}
+				if !slices.Equal(got, test.want) {
+					t.Errorf("QueryPages(%+v) = %v, want %v", test.q, got, test.want)
+				}
+				for _, p := range pages {
+					if !p.Key.Parent.Equal(site) {
+						t.Errorf("QueryPages(%+v) returned %v from another site", test.q, p.Key)
+					}
+					if p.Created.IsZero() != test.q.KeysOnly {
+						t.Errorf("QueryPages(%+v) returned %v with Created = %v", test.q, p.Key, p.Created)
+					}
+					if (p.Title == "") != (test.q.KeysOnly || test.q.TimesOnly) {
+						t.Errorf("QueryPages(%+v) returned %v with Title = %q", test.q, p.Key, p.Title)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStoreRelink(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			site := datastore.NameKey("Site", "test", nil)
+			key := func(name string) *datastore.Key { return datastore.NameKey("Page", name, site) }
+			putTestPages(t, st, site)
+
+			changed, err := st.Relink(ctx, site)
+			if err != nil {
+				t.Fatalf("Relink() = %v", err)
+			}
+			got := make([]string, 0, len(changed))
+			for _, k := range changed {
+				got = append(got, k.Name)
+			}
+			slices.Sort(got)
+			if want := []string{"first", "second"}; !slices.Equal(got, want) {
+				t.Errorf("Relink() changed %v, want %v", got, want)
+			}
+
+			pages, err := st.GetPages(ctx, []*datastore.Key{key("first"), key("second"), key("about"), key("draft")})
+			if err != nil {
+				t.Fatalf("GetPages() = %v", err)
+			}
+			first, second, about, draft := pages[0], pages[1], pages[2], pages[3]
+			if first.Prev != nil || !first.Next.Equal(key("second")) {
+				t.Errorf("first: Prev, Next = %v, %v; want nil, second", first.Prev, first.Next)
+			}
+			if !second.Prev.Equal(key("first")) || second.Next != nil {
+				t.Errorf("second: Prev, Next = %v, %v; want first, nil", second.Prev, second.Next)
+			}
+			for _, p := range []*Page{about, draft} {
+				if p.Prev != nil || p.Next != nil {
+					t.Errorf("%s: Prev, Next = %v, %v; want nil, nil", p.Key.Name, p.Prev, p.Next)
+				}
+			}
+
+			// Relinking again changes nothing.
+			if changed, err := st.Relink(ctx, site); err != nil || len(changed) != 0 {
+				t.Errorf("Relink() again = %v, %v; want no changes", changed, err)
+			}
+
+			// Unpublishing a post relinks its neighbours.
+			second.Published = false
+			if err := st.PutPage(ctx, second); err != nil {
+				t.Fatalf("PutPage(second) = %v", err)
+			}
+			if changed, err := st.Relink(ctx, site); err != nil || len(changed) != 1 || changed[0].Name != "first" {
+				t.Errorf("Relink() after unpublishing = %v, %v; want [first]", changed, err)
+			}
+			if p, _ := st.GetPage(ctx, key("first")); p.Next != nil {
+				t.Errorf("first: Next = %v, want nil", p.Next)
+			}
+		})
+	}
+}
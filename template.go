@@ -0,0 +1,285 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Default layouts for each kind of page, used when a page has no Layout (or
+// its Layout doesn't exist). If the default for the kind doesn't exist either,
+// the site's page template is used.
+const (
+	postLayout     = "post.html"
+	pageLayout     = "page.html"
+	indexLayout    = "index.html"
+	notFoundLayout = "notfound.html"
+)
+
+// pageTemplate is a parsed set of page templates. Once parsed it is never
+// modified; reloading replaces it.
+type pageTemplate struct {
+	tmpl   *template.Template // includes every file, named by base name
+	main   string             // name of the fallback layout
+	files  []string
+	mtime  time.Time // latest modification time of the files
+	loaded time.Time
+}
+
+// templateStatus records problems with a site's page template, for the
+// admin page.
+type templateStatus struct {
+	ParseErr     error // from the last attempt to parse, or nil
+	ParseErrTime time.Time
+	ExecErr      error // from the most recent failed execution, or nil
+	ExecErrTime  time.Time
+}
+
+// templateGlob returns the pattern matching the template files of the site.
+//
+// If the site has a TemplateDir, every .html file in it is parsed into one
+// set, so they can all use each other's definitions, and PageTemplate names
+// the fallback layout within it. Otherwise PageTemplate is the path of the
+// fallback layout, and partials are the files in the same directory with the
+// same extension whose names begin with an underscore (e.g. _header.html).
+// Either way, every file is available as a layout by its base name.
+func (s *Site) templateGlob() string {
+	if s.TemplateDir != "" {
+		return filepath.Join(s.TemplateDir, "*.html")
+	}
+	return filepath.Join(filepath.Dir(s.PageTemplate), "_*"+filepath.Ext(s.PageTemplate))
+}
+
+// templateWatchDir returns the directory to watch for template changes.
+func (s *Site) templateWatchDir() string {
+	if s.TemplateDir != "" {
+		return s.TemplateDir
+	}
+	return filepath.Dir(s.PageTemplate)
+}
+
+// isTemplateFile reports whether name is one of the template files of the
+// site (or would be, if it existed).
+func (s *Site) isTemplateFile(name string) bool {
+	name = filepath.Clean(name)
+	if s.TemplateDir == "" && name == filepath.Clean(s.PageTemplate) {
+		return true
+	}
+	m, _ := filepath.Match(filepath.Base(s.templateGlob()), filepath.Base(name))
+	return m && filepath.Dir(name) == filepath.Clean(s.templateWatchDir())
+}
+
+// parsePageTemplate parses the page templates of a site.
+func parsePageTemplate(s *Site, funcs template.FuncMap) (*pageTemplate, error) {
+	glob := s.templateGlob()
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, fmt.Errorf("find templates: %v", err)
+	}
+	pt := &pageTemplate{
+		main:   filepath.Base(s.PageTemplate),
+		files:  matches,
+		loaded: time.Now(),
+	}
+	tmpl := template.New(pt.main).Funcs(funcs)
+	if s.TemplateDir != "" {
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no templates in %q", s.TemplateDir)
+		}
+		tmpl, err = tmpl.ParseGlob(glob)
+	} else {
+		pt.files = append([]string{s.PageTemplate}, matches...)
+		tmpl, err = tmpl.ParseFiles(pt.files...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse page template: %v", err)
+	}
+	if t := tmpl.Lookup(pt.main); t == nil || t.Tree == nil {
+		return nil, fmt.Errorf("page template %q not found", pt.main)
+	}
+	for _, f := range pt.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("find page template: %v", err)
+		}
+		pt.mtime = maxTime(pt.mtime, fi.ModTime())
+	}
+	pt.tmpl = tmpl
+	return pt, nil
+}
+
+// layout returns the first of the named templates that exists, or the
+// fallback layout if none do.
+func (pt *pageTemplate) layout(names ...string) *template.Template {
+	for _, name := range names {
+		if t := pt.tmpl.Lookup(name); t != nil && t.Tree != nil {
+			return t
+		}
+	}
+	return pt.tmpl.Lookup(pt.main)
+}
+
+// layouts returns the names of the templates that can be chosen as a page
+// layout: each file, other than partials.
+func (pt *pageTemplate) layouts() []string {
+	var names []string
+	for _, f := range pt.files {
+		if name := filepath.Base(f); !strings.HasPrefix(name, "_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// template returns the current page template of the site.
+func (s *Site) template() *pageTemplate {
+	return s.pageTmpl.Load()
+}
+
+// templateStatus returns a copy of the template status of the site.
+func (s *Site) templateStatus() templateStatus {
+	s.tmplMu.Lock()
+	defer s.tmplMu.Unlock()
+	return s.tmplStatus
+}
+
+// reloadTemplate re-parses the page template of the site. If parsing fails,
+// the error is recorded and the previous template continues to be used.
+func (s *Site) reloadTemplate(funcs template.FuncMap) error {
+	pt, err := parsePageTemplate(s, funcs)
+	s.tmplMu.Lock()
+	defer s.tmplMu.Unlock()
+	if err != nil {
+		s.tmplStatus.ParseErr, s.tmplStatus.ParseErrTime = err, time.Now()
+		return err
+	}
+	s.pageTmpl.Store(pt)
+	s.tmplStatus = templateStatus{}
+	return nil
+}
+
+// templateExecError records an error executing the page template.
+func (s *Site) templateExecError(err error) {
+	log.Printf("Couldn't execute template: %v", err)
+	s.tmplMu.Lock()
+	defer s.tmplMu.Unlock()
+	s.tmplStatus.ExecErr, s.tmplStatus.ExecErrTime = err, time.Now()
+}
+
+// watchTemplate watches the directory containing the page templates, and
+// reloads them (and purges the cache, since everything rendered with the old
+// templates is out of date) after changes.
+func (s *server) watchTemplate() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create watcher: %v", err)
+	}
+	dir := s.site.templateWatchDir()
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return fmt.Errorf("watch %q: %v", dir, err)
+	}
+	s.tmplWatcher = w
+	go watchSettled(w, s.site.PageTemplate, s.site.isTemplateFile, s.reloadTemplate)
+	return nil
+}
+
+// reloadTemplate reloads the page templates after they change.
+func (s *server) reloadTemplate() {
+	if err := s.site.reloadTemplate(s.options.templateFuncs); err != nil {
+		log.Printf("Couldn't reload page template: %v", err)
+		return
+	}
+	log.Printf("Reloaded page template %q", s.site.PageTemplate)
+	s.cache.removePrefix("")
+}
+
+var templateAdminTmpl = template.Must(template.New("template.html").Parse(`<!DOCTYPE html>
+<html>
+
+<head>
+	<title>Page template</title>
+	<link rel="shortcut icon" href="/favicon.ico">
+	<link rel="stylesheet" href="https://fonts.googleapis.com/icon?family=Material+Icons">
+	<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/css/materialize.min.css" media="screen,projection" />
+	<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+</head>
+
+<body>
+	<header class="section light-blue darken-1">
+		<div class="container">
+			<h3 class="white-text">Page template</h3>
+		</div>
+	</header>
+	<article class="section">
+		<div class="container">
+			<table>
+				<tr><th>Files</th><td>{{range .Files}}{{.}}<br>{{end}}</td></tr>
+				<tr><th>Layouts</th><td>{{range .Layouts}}{{.}}<br>{{end}}</td></tr>
+				<tr><th>Last modified</th><td>{{.MTime.Format "2006-01-02 15:04:05"}}</td></tr>
+				<tr><th>Loaded</th><td>{{.Loaded.Format "2006-01-02 15:04:05"}}</td></tr>
+			</table>
+			{{with .Status}}
+			{{if .ParseErr}}
+			<h5 class="red-text">Parse error ({{.ParseErrTime.Format "2006-01-02 15:04:05"}})</h5>
+			<p>The previously loaded template is still being used.</p>
+			<pre>{{.ParseErr}}</pre>
+			{{end}}
+			{{if .ExecErr}}
+			<h5 class="red-text">Execution error ({{.ExecErrTime.Format "2006-01-02 15:04:05"}})</h5>
+			<pre>{{.ExecErr}}</pre>
+			{{end}}
+			{{if not (or .ParseErr .ExecErr)}}<p class="green-text">No errors.</p>{{end}}
+			{{end}}
+		</div>
+	</article>
+	<script type="text/javascript" src="https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/js/materialize.min.js"></script>
+</body>
+
+</html>`))
+
+type templateAdminPage struct {
+	Files   []string
+	Layouts []string
+	MTime   time.Time
+	Loaded  time.Time
+	Status  templateStatus
+}
+
+func (s *server) handleTemplateAdmin(w http.ResponseWriter, r *http.Request) {
+	pt := s.site.template()
+	tp := &templateAdminPage{
+		Files:   pt.files,
+		Layouts: pt.layouts(),
+		MTime:   pt.mtime,
+		Loaded:  pt.loaded,
+		Status:  s.site.templateStatus(),
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := templateAdminTmpl.Execute(w, tp); err != nil {
+		log.Printf("Couldn't execute templateAdminTmpl: %v", err)
+	}
+}
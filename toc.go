@@ -0,0 +1,142 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TOCEntry is a heading in a page's table of contents.
+type TOCEntry struct {
+	Level    int    // 1 to 6, as in <h1> to <h6>
+	ID       string // of the heading element, for linking to
+	Title    string // text of the heading, without markup
+	Children []*TOCEntry
+}
+
+var (
+	headingRE = regexp.MustCompile(`(?s)<h([1-6])([^>]*)>(.*?)</h[1-6]>`)
+	idAttrRE  = regexp.MustCompile(`\bid="([^"]*)"`)
+	tagRE     = regexp.MustCompile(`<[^>]*>`)
+
+	// MathML annotations hold the TeX source, which isn't part of the text.
+	annotationRE = regexp.MustCompile(`(?s)<annotation\b.*?</annotation>`)
+)
+
+// headingText returns the text of the HTML inside a heading, without markup.
+func headingText(inner string) string {
+	inner = annotationRE.ReplaceAllString(inner, "")
+	return strings.TrimSpace(html.UnescapeString(tagRE.ReplaceAllString(inner, "")))
+}
+
+// slugify turns heading text into something usable as an ID: lower-case
+// letters and digits, separated by single hyphens.
+func slugify(s string) string {
+	var sb strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		hyphen = true
+	}
+	if sb.Len() == 0 {
+		return "section"
+	}
+	return sb.String()
+}
+
+// addHeadingIDs gives every heading in the HTML an ID (keeping any it
+// already has), making sure generated IDs are unique within the HTML, and
+// returns the headings as a nested table of contents.
+func addHeadingIDs(src string) (string, []*TOCEntry) {
+	used := make(map[string]bool)
+	for _, m := range headingRE.FindAllStringSubmatch(src, -1) {
+		if id := idAttrRE.FindStringSubmatch(m[2]); id != nil {
+			used[html.UnescapeString(id[1])] = true
+		}
+	}
+
+	var toc []*TOCEntry
+	var stack []*TOCEntry // path from the root to the most recent entry
+	out := headingRE.ReplaceAllStringFunc(src, func(h string) string {
+		m := headingRE.FindStringSubmatch(h)
+		level, _ := strconv.Atoi(m[1])
+		attrs, inner := m[2], m[3]
+		ent := &TOCEntry{
+			Level: level,
+			Title: headingText(inner),
+		}
+		if id := idAttrRE.FindStringSubmatch(attrs); id != nil {
+			ent.ID = html.UnescapeString(id[1])
+		} else {
+			base := slugify(ent.Title)
+			ent.ID = base
+			for n := 1; used[ent.ID]; n++ {
+				ent.ID = base + "-" + strconv.Itoa(n)
+			}
+			used[ent.ID] = true
+			attrs = ` id="` + html.EscapeString(ent.ID) + `"` + attrs
+			h = "<h" + m[1] + attrs + ">" + inner + "</h" + m[1] + ">"
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].Level >= level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			toc = append(toc, ent)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, ent)
+		}
+		stack = append(stack, ent)
+		return h
+	})
+	return out, toc
+}
+
+// tocHTML renders a table of contents as nested lists.
+func tocHTML(toc []*TOCEntry) template.HTML {
+	if len(toc) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	var write func([]*TOCEntry)
+	write = func(ents []*TOCEntry) {
+		sb.WriteString("<ul>")
+		for _, e := range ents {
+			sb.WriteString(`<li><a href="#` + html.EscapeString(e.ID) + `">` + html.EscapeString(e.Title) + "</a>")
+			if len(e.Children) > 0 {
+				write(e.Children)
+			}
+			sb.WriteString("</li>")
+		}
+		sb.WriteString("</ul>")
+	}
+	sb.WriteString(`<nav class="toc">`)
+	write(toc)
+	sb.WriteString("</nav>")
+	return template.HTML(sb.String())
+}
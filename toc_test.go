@@ -0,0 +1,67 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddHeadingIDs(t *testing.T) {
+	tests := []struct {
+		name, md  string
+		wantID    string
+		wantTitle string
+	}{
+		{"plain", "## Some Heading", "some-heading", "Some Heading"},
+		{"markup", "## *Some* `code`", "some-code", "Some code"},
+		{"math", "## Heading $x^2$", "heading-x2", "Heading x2"},
+	}
+	for _, r := range []struct {
+		name string
+		r    MarkdownRenderer
+	}{
+		{"blackfriday", BlackfridayRenderer()},
+		{"goldmark", GoldmarkRenderer()},
+	} {
+		o := newOptions(nil)
+		for _, test := range tests {
+			t.Run(r.name+"/"+test.name, func(t *testing.T) {
+				h, toc, err := o.render(r.r, test.md)
+				if err != nil {
+					t.Fatalf("render(%q) error = %v", test.md, err)
+				}
+				if len(toc) != 1 {
+					t.Fatalf("render(%q) toc = %v, want 1 entry", test.md, toc)
+				}
+				// goldmark's IDs can't see inside math.
+				if r.name == "blackfriday" || !strings.Contains(test.md, "$") {
+					if got := toc[0].ID; got != test.wantID {
+						t.Errorf("render(%q) ID = %q, want %q", test.md, got, test.wantID)
+					}
+				}
+				if got := toc[0].Title; got != test.wantTitle {
+					t.Errorf("render(%q) Title = %q, want %q", test.md, got, test.wantTitle)
+				}
+				if strings.Contains(toc[0].ID, "placeholder") {
+					t.Errorf("render(%q) ID = %q, contains placeholder", test.md, toc[0].ID)
+				}
+				if !strings.Contains(string(h), `id="`+toc[0].ID+`"`) {
+					t.Errorf("render(%q) = %q, missing id %q", test.md, h, toc[0].ID)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Josh Deprez. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saebr
+
+import (
+	"log"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// settleTime is how long watchSettled waits for changes to stop arriving.
+const settleTime = 200 * time.Millisecond
+
+// watchSettled calls reload after files reported by the watcher change.
+// Changes usually arrive in bursts (editors save files in several steps, git
+// checkout changes many files), so it waits for things to settle first.
+// Changes to files for which relevant returns false are ignored. It returns
+// once the watcher is closed.
+func watchSettled(w *fsnotify.Watcher, what string, relevant func(name string) bool, reload func()) {
+	timer := time.NewTimer(settleTime)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if !relevant(ev.Name) {
+				continue
+			}
+			timer.Reset(settleTime)
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watching %q: %v", what, err)
+
+		case <-timer.C:
+			reload()
+		}
+	}
+}